@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+Authorization scheme and gRPC metadata key of API keys.
+
+	Authorization: ApiKey {id}.{secret}
+	x-api-key: {id}.{secret}
+ */
+
+const (
+	ApiKeyScheme   = "ApiKey"
+	ApiKeyMetadata = "x-api-key"
+)
+
+/**
+Key prefix of API keys in storage.
+
+	auth/apikey/{id}  API key record with sha256 of the key
+ */
+
+const ApiKeyPrefix = "auth/apikey/"
+
+var (
+	ErrInvalidApiKey = errors.New("invalid api key")
+	ErrExpiredApiKey = errors.New("expired api key")
+)
+
+type ApiKeyInfo struct {
+
+	/**
+	Public part of the key, used to list and revoke it.
+	 */
+
+	Id string `json:"id"`
+
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username"`
+
+	/**
+	Roles and context entries of AuthorizedUser authenticated by the key.
+	 */
+
+	Roles   []string          `json:"roles,omitempty"`
+	Context map[string]string `json:"context,omitempty"`
+
+	/**
+	Time in milliseconds, zero ExpiresAt for keys without expiration.
+	 */
+
+	CreatedAt int64 `json:"createdAt"`
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	/**
+	Hex of sha256 of the whole key, the key itself is not stored.
+	 */
+
+	Hash string `json:"hash"`
+}
+
+/**
+Storage of API keys for machine clients, used by AuthorizationMiddleware in Authenticate and AuthenticateByHeader.
+ */
+
+type ApiKeyStore interface {
+
+	/**
+	Creates API key scoped to the roles and context of the user. Zero ttl means no expiration, otherwise at least 1s.
+	Returns the key, it is shown only once.
+	 */
+
+	Create(name string, user *AuthorizedUser, ttl time.Duration) (string, *ApiKeyInfo, error)
+
+	/**
+	Lists keys of the user, empty username lists all keys.
+	 */
+
+	List(username string) ([]*ApiKeyInfo, error)
+
+	/**
+	Removes key by id.
+	 */
+
+	Revoke(id string) error
+
+	/**
+	Checks the key and returns AuthorizedUser with scope of the key.
+	 */
+
+	Authenticate(key string) (*AuthorizedUser, error)
+}
+
+type implApiKeyStore struct {
+	storage store.DataStore
+}
+
+func NewApiKeyStore(storage store.DataStore) ApiKeyStore {
+	return &implApiKeyStore{storage: storage}
+}
+
+func (t *implApiKeyStore) Create(name string, user *AuthorizedUser, ttl time.Duration) (string, *ApiKeyInfo, error) {
+
+	if user.Username == "" {
+		return "", nil, errors.New("empty username")
+	}
+
+	// storage TTL is in seconds, sub-second ttl would turn into zero meaning no expiration
+	if ttl != 0 && ttl < time.Second {
+		return "", nil, errors.Errorf("invalid api key ttl %v, expected at least 1s or zero for no expiration", ttl)
+	}
+
+	id, err := randomToken(9)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := id + "." + secret
+
+	info := &ApiKeyInfo{
+		Id:        id,
+		Name:      name,
+		Username:  user.Username,
+		Context:   user.Context,
+		CreatedAt: time.Now().UnixMilli(),
+		Hash:      tokenHash(key),
+	}
+	for role, ok := range user.Roles {
+		if ok {
+			info.Roles = append(info.Roles, role)
+		}
+	}
+	sort.Strings(info.Roles)
+
+	ttlSeconds := store.NoTTL
+	if ttl > 0 {
+		info.ExpiresAt = info.CreatedAt + ttl.Milliseconds()
+		// round up to keep the record till ExpiresAt
+		ttlSeconds = int((ttl + time.Second - 1) / time.Second)
+	}
+
+	value, err := json.Marshal(info)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := SetWithTtl(context.Background(), t.storage, []byte(ApiKeyPrefix+id), value, ttlSeconds); err != nil {
+		return "", nil, errors.Errorf("store api key, %v", err)
+	}
+
+	return key, info, nil
+}
+
+func (t *implApiKeyStore) List(username string) ([]*ApiKeyInfo, error) {
+
+	var list []*ApiKeyInfo
+	err := t.storage.EnumerateRaw(context.Background(), []byte(ApiKeyPrefix), []byte(ApiKeyPrefix), store.DefaultBatchSize, false, false, func(entry *store.RawEntry) bool {
+		info := new(ApiKeyInfo)
+		if json.Unmarshal(entry.Value, info) != nil {
+			return true
+		}
+		if username == "" || info.Username == username {
+			list = append(list, info)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Errorf("enumerate api keys, %v", err)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt < list[j].CreatedAt
+	})
+	return list, nil
+}
+
+func (t *implApiKeyStore) Revoke(id string) error {
+
+	ctx := context.Background()
+	key := []byte(ApiKeyPrefix + id)
+
+	value, err := t.storage.GetRaw(ctx, key, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return errors.Errorf("api key '%s' not found", id)
+	}
+
+	return t.storage.RemoveRaw(ctx, key)
+}
+
+func (t *implApiKeyStore) Authenticate(key string) (*AuthorizedUser, error) {
+
+	i := strings.IndexByte(key, '.')
+	if i <= 0 {
+		return nil, ErrInvalidApiKey
+	}
+
+	value, err := t.storage.GetRaw(context.Background(), []byte(ApiKeyPrefix+key[:i]), nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, ErrInvalidApiKey
+	}
+
+	info := new(ApiKeyInfo)
+	if err := json.Unmarshal(value, info); err != nil {
+		return nil, ErrInvalidApiKey
+	}
+
+	if subtle.ConstantTimeCompare([]byte(info.Hash), []byte(tokenHash(key))) != 1 {
+		return nil, ErrInvalidApiKey
+	}
+
+	if info.ExpiresAt > 0 && info.ExpiresAt < time.Now().UnixMilli() {
+		return nil, ErrExpiredApiKey
+	}
+
+	user := &AuthorizedUser{
+		Username:  info.Username,
+		Roles:     make(map[string]bool),
+		Context:   info.Context,
+		ExpiresAt: info.ExpiresAt,
+	}
+	for _, role := range info.Roles {
+		user.Roles[role] = true
+	}
+
+	return user, nil
+}
+
+/**
+Extracts API key from 'Authorization: ApiKey ...' header value.
+ */
+
+func ParseApiKeyHeader(authHeader string) (string, bool) {
+	if len(authHeader) > len(ApiKeyScheme)+1 && strings.EqualFold(authHeader[:len(ApiKeyScheme)], ApiKeyScheme) && authHeader[len(ApiKeyScheme)] == ' ' {
+		return strings.TrimSpace(authHeader[len(ApiKeyScheme)+1:]), true
+	}
+	return "", false
+}
+
+/**
+Extracts API key from 'x-api-key' or 'authorization' metadata entries of gRPC incoming context.
+ */
+
+func ApiKeyFromContext(ctx context.Context) (string, bool) {
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	if list := md.Get(ApiKeyMetadata); len(list) > 0 && list[0] != "" {
+		return list[0], true
+	}
+
+	for _, header := range md.Get("authorization") {
+		if key, ok := ParseApiKeyHeader(header); ok {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+/**
+Executes API key command for AuthorizationMiddleware.ExecuteCommand:
+
+	apikey create {username} {roles} [name=value] [ttl=720h] [key=value...]
+	apikey list [username]
+	apikey revoke {id}
+
+Roles are comma separated, ttl is a duration. Other 'key=value' arguments are placed in to the user context.
+ */
+
+func ExecuteApiKeyCommand(keys ApiKeyStore, args []string) (string, error) {
+
+	if len(args) == 0 {
+		return "", errors.New("expected 'create', 'list' or 'revoke' api key command")
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			return "", errors.New("usage: apikey create {username} {roles} [name=value] [ttl=720h] [key=value...]")
+		}
+
+		user := &AuthorizedUser{
+			Username: args[1],
+			Roles:    make(map[string]bool),
+			Context:  make(map[string]string),
+		}
+		for _, role := range strings.Split(args[2], ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				user.Roles[role] = true
+			}
+		}
+
+		var name string
+		var ttl time.Duration
+		for _, arg := range args[3:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return "", errors.Errorf("invalid argument '%s', expected 'name=value', 'ttl=duration' or 'key=value'", arg)
+			}
+			switch kv[0] {
+			case "name":
+				name = kv[1]
+			case "ttl":
+				d, err := time.ParseDuration(kv[1])
+				if err != nil {
+					return "", errors.Errorf("invalid ttl '%s', %v", kv[1], err)
+				}
+				ttl = d
+			default:
+				user.Context[kv[0]] = kv[1]
+			}
+		}
+
+		key, info, err := keys.Create(name, user, ttl)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("id: %s\nkey: %s\n", info.Id, key), nil
+
+	case "list":
+		var username string
+		if len(args) > 1 {
+			username = args[1]
+		}
+		list, err := keys.List(username)
+		if err != nil {
+			return "", err
+		}
+		return FormatApiKeys(list), nil
+
+	case "revoke":
+		if len(args) < 2 {
+			return "", errors.New("usage: apikey revoke {id}")
+		}
+		if err := keys.Revoke(args[1]); err != nil {
+			return "", err
+		}
+		return "revoked " + args[1], nil
+
+	default:
+		return "", errors.Errorf("unknown api key command '%s'", args[0])
+	}
+}
+
+func FormatApiKeys(list []*ApiKeyInfo) string {
+
+	var out strings.Builder
+	tw := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tUSERNAME\tROLES\tCREATED\tEXPIRES")
+	for _, info := range list {
+		expires := "never"
+		if info.ExpiresAt > 0 {
+			expires = time.UnixMilli(info.ExpiresAt).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Id, info.Name, info.Username,
+			strings.Join(info.Roles, ","),
+			time.UnixMilli(info.CreatedAt).UTC().Format(time.RFC3339),
+			expires)
+	}
+	tw.Flush()
+	return out.String()
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"google.golang.org/grpc/metadata"
+	"testing"
+	"time"
+)
+
+var testApiKeyUser = &AuthorizedUser{
+	Username: "robot",
+	Roles:    map[string]bool{"reader": true, "writer": false},
+	Context:  map[string]string{"team": "ops"},
+}
+
+func TestApiKeyCreateAuthenticateRevoke(t *testing.T) {
+
+	ds := newTestDataStore()
+	keys := NewApiKeyStore(ds)
+
+	key, info, err := keys.Create("ci", testApiKeyUser, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "ci" || len(info.Roles) != 1 || info.ExpiresAt != info.CreatedAt+time.Hour.Milliseconds() || ds.ttls[ApiKeyPrefix+info.Id] != 3600 {
+		t.Fatalf("unexpected key info %+v", info)
+	}
+
+	user, err := keys.Authenticate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "robot" || !user.Roles["reader"] || user.Roles["writer"] || user.Context["team"] != "ops" || user.ExpiresAt != info.ExpiresAt {
+		t.Fatalf("unexpected user %+v", user)
+	}
+
+	for _, invalid := range []string{"", "nodot", info.Id + ".wrong", "unknown." + key[len(info.Id)+1:]} {
+		if _, err := keys.Authenticate(invalid); err != ErrInvalidApiKey {
+			t.Fatalf("key '%s' is authenticated, %v", invalid, err)
+		}
+	}
+
+	list, err := keys.List("robot")
+	if err != nil || len(list) != 1 || list[0].Id != info.Id {
+		t.Fatalf("unexpected list %v, %v", list, err)
+	}
+	if list, _ := keys.List("other"); len(list) != 0 {
+		t.Fatal("keys of the other user are listed")
+	}
+
+	if err := keys.Revoke(info.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Authenticate(key); err != ErrInvalidApiKey {
+		t.Fatalf("revoked key is authenticated, %v", err)
+	}
+	if err := keys.Revoke(info.Id); err == nil {
+		t.Fatal("expected error on revoke of unknown key")
+	}
+}
+
+func TestApiKeyTtl(t *testing.T) {
+
+	ds := newTestDataStore()
+	keys := NewApiKeyStore(ds)
+
+	for _, ttl := range []time.Duration{time.Millisecond, 999 * time.Millisecond, -time.Second} {
+		if _, _, err := keys.Create("short", testApiKeyUser, ttl); err == nil {
+			t.Fatalf("ttl %v is accepted", ttl)
+		}
+	}
+
+	// partial seconds are rounded up
+	_, info, err := keys.Create("rounded", testApiKeyUser, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ds.ttls[ApiKeyPrefix+info.Id]; ttl != 2 {
+		t.Fatalf("unexpected storage ttl %d", ttl)
+	}
+
+	// expired key is rejected on backends without native TTL
+	key, _, err := keys.Create("expired", testApiKeyUser, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := keys.Authenticate(key); err != ErrExpiredApiKey {
+		t.Fatalf("expected expired key, got %v", err)
+	}
+
+	_, info, err = keys.Create("forever", testApiKeyUser, 0)
+	if err != nil || info.ExpiresAt != 0 {
+		t.Fatalf("unexpected key without expiration %+v, %v", info, err)
+	}
+}
+
+func TestParseApiKeyHeader(t *testing.T) {
+
+	cases := []struct {
+		header string
+		key    string
+		ok     bool
+	}{
+		{"ApiKey abc.def", "abc.def", true},
+		{"apikey  abc.def ", "abc.def", true},
+		{"Bearer abc.def", "", false},
+		{"ApiKeyabc.def", "", false},
+		{"ApiKey", "", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		key, ok := ParseApiKeyHeader(c.header)
+		if key != c.key || ok != c.ok {
+			t.Errorf("'%s' parsed to '%s' %v", c.header, key, ok)
+		}
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "ApiKey abc.def"))
+	if key, ok := ApiKeyFromContext(ctx); !ok || key != "abc.def" {
+		t.Fatalf("authorization metadata parsed to '%s'", key)
+	}
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(ApiKeyMetadata, "abc.def"))
+	if key, ok := ApiKeyFromContext(ctx); !ok || key != "abc.def" {
+		t.Fatalf("api key metadata parsed to '%s'", key)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/codeallergy/glue"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var AssetRouterClass = reflect.TypeOf((*AssetRouter)(nil)).Elem()
+
+/**
+Router serving static assets from http.FileSystem and ResourceService beans.
+
+Supports content-hashed ETags with If-None-Match, Cache-Control policies,
+precompressed '.br' and '.gz' variants and SPA fallback to 'index.html' for unknown paths.
+*/
+
+type AssetRouter interface {
+	Router
+	glue.InitializingBean
+
+	/**
+	Drops cached assets, the next request would load them again from the sources.
+	 */
+
+	Reset()
+}
+
+/**
+Precompressed variants in the order of preference, file is looking as '{name}{ext}' next to the original.
+ */
+
+var assetEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type assetEntry struct {
+	content  []byte
+	etag     string
+	encoding string
+}
+
+type implAssetRouter struct {
+	FileSystem      http.FileSystem `inject:"optional"`
+	ResourceService ResourceService `inject:"optional"`
+
+	/**
+	Cache-Control max-age in seconds for regular assets.
+	 */
+	MaxAge int `value:"assets.max-age,default=3600"`
+
+	/**
+	Regular expression to detect content-hashed file names like 'main.3f2a1b4c.js' that are cached forever.
+	 */
+	ImmutablePattern string `value:"assets.immutable-pattern,default=[.-][0-9a-f]{8}[0-9a-f]*\\.[0-9a-z]+$"`
+
+	/**
+	SPA entry page served for unknown paths without extension, empty value disables fallback.
+	 */
+	Fallback string `value:"assets.fallback,default=index.html"`
+
+	pattern   string
+	immutable *regexp.Regexp
+
+	cacheMu sync.RWMutex
+	cache   map[string]*assetEntry
+}
+
+/**
+Creates asset router serving the url pattern, for example '/' or '/static/'.
+ */
+
+func NewAssetRouter(pattern string) AssetRouter {
+	return &implAssetRouter{
+		pattern: pattern,
+		cache:   make(map[string]*assetEntry),
+	}
+}
+
+func (t *implAssetRouter) PostConstruct() (err error) {
+
+	if t.FileSystem == nil && t.ResourceService == nil {
+		return errors.Errorf("asset router '%s' needs http.FileSystem or sprint.ResourceService bean", t.pattern)
+	}
+
+	if t.ImmutablePattern != "" {
+		t.immutable, err = regexp.Compile(t.ImmutablePattern)
+		if err != nil {
+			return errors.Errorf("invalid property 'assets.immutable-pattern' value '%s', %v", t.ImmutablePattern, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *implAssetRouter) Pattern() string {
+	return t.pattern
+}
+
+func (t *implAssetRouter) Reset() {
+	t.cacheMu.Lock()
+	t.cache = make(map[string]*assetEntry)
+	t.cacheMu.Unlock()
+}
+
+func (t *implAssetRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if prefix := strings.Trim(t.pattern, "/"); prefix != "" && (name == prefix || strings.HasPrefix(name, prefix+"/")) {
+		name = strings.TrimPrefix(name[len(prefix):], "/")
+	}
+	if name == "" {
+		name = "index.html"
+	}
+
+	accepted := r.Header.Get("Accept-Encoding")
+
+	asset, ok := t.lookup(name, accepted)
+	if !ok {
+		if t.Fallback == "" || path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		name = t.Fallback
+		if asset, ok = t.lookup(name, accepted); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	h := w.Header()
+	h.Set("ETag", asset.etag)
+	h.Set("Cache-Control", t.cacheControl(name))
+	h.Add("Vary", "Accept-Encoding")
+	if asset.encoding != "" {
+		h.Set("Content-Encoding", asset.encoding)
+	}
+
+	// ServeContent detects Content-Type by the original name and handles If-None-Match and Range headers
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(asset.content))
+}
+
+func (t *implAssetRouter) cacheControl(name string) string {
+	switch {
+	case name == t.Fallback || path.Ext(name) == ".html":
+		return "no-cache"
+	case t.immutable != nil && t.immutable.MatchString(path.Base(name)):
+		return "public, max-age=31536000, immutable"
+	default:
+		return "public, max-age=" + strconv.Itoa(t.MaxAge)
+	}
+}
+
+/**
+Finds the best representation of the asset for the accepted encodings.
+ */
+
+func (t *implAssetRouter) lookup(name, accepted string) (*assetEntry, bool) {
+
+	for _, enc := range assetEncodings {
+		if acceptsEncoding(accepted, enc.name) {
+			if asset, ok := t.load(name, enc.ext, enc.name); ok {
+				return asset, true
+			}
+		}
+	}
+
+	return t.load(name, "", "")
+}
+
+func (t *implAssetRouter) load(name, ext, encoding string) (*assetEntry, bool) {
+
+	key := name + ext
+
+	t.cacheMu.RLock()
+	asset, cached := t.cache[key]
+	t.cacheMu.RUnlock()
+
+	if cached {
+		return asset, true
+	}
+
+	// do not cache missing assets, otherwise random urls would grow the cache
+	content, err := t.readAsset(key)
+	if err != nil {
+		return nil, false
+	}
+
+	sum := sha256.Sum256(content)
+	etag := hex.EncodeToString(sum[:16])
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+
+	asset = &assetEntry{
+		content:  content,
+		etag:     strconv.Quote(etag),
+		encoding: encoding,
+	}
+
+	t.cacheMu.Lock()
+	t.cache[key] = asset
+	t.cacheMu.Unlock()
+
+	return asset, true
+}
+
+func (t *implAssetRouter) readAsset(name string) ([]byte, error) {
+
+	if t.FileSystem != nil {
+		content, err := readFileSystem(t.FileSystem, "/"+name)
+		if err == nil || !os.IsNotExist(err) || t.ResourceService == nil {
+			return content, err
+		}
+	}
+
+	return t.ResourceService.GetResource(name)
+}
+
+func readFileSystem(fs http.FileSystem, name string) ([]byte, error) {
+
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	return ioutil.ReadAll(file)
+}
+
+/**
+Checks that Accept-Encoding header value contains the encoding without 'q=0' weight.
+ */
+
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != encoding {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
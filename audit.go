@@ -0,0 +1,451 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+Key prefix of audit records in storage, ULID keeps records ordered by time.
+
+	audit/{ulid}  audit record
+ */
+
+const AuditPrefix = "audit/"
+
+/**
+Property with retention of audit records in storage, for example 'audit.retention=2160h'.
+ */
+
+const AuditRetentionProperty = "audit.retention"
+
+var DefaultAuditRetention = 90 * 24 * time.Hour
+
+/**
+Kinds of audit records.
+ */
+
+const (
+	AuditCall         = "call"
+	AuditDenied       = "denied"
+	AuditConfigSet    = "config"
+	AuditShutdown     = "shutdown"
+	AuditInvalidation = "invalidate"
+)
+
+var AuditLogClass = reflect.TypeOf((*AuditLog)(nil)).Elem()
+
+type AuditRecord struct {
+
+	/**
+	Time in milliseconds.
+	 */
+
+	Time int64 `json:"time"`
+
+	Kind     string   `json:"kind"`
+	Username string   `json:"user,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+
+	/**
+	Full gRPC method, config key or other subject of the action.
+	 */
+
+	Method string `json:"method,omitempty"`
+
+	/**
+	gRPC status code name, 'OK' on success.
+	 */
+
+	Code string `json:"code,omitempty"`
+
+	/**
+	Latency in microseconds.
+	 */
+
+	Latency int64 `json:"latency,omitempty"`
+
+	Detail string `json:"detail,omitempty"`
+}
+
+/**
+Audit log writes records to the rotating file, usually *lumberjack.Logger bean, and to the storage for queries.
+ */
+
+type AuditLog interface {
+
+	/**
+	Writes record, zero Time means now.
+	 */
+
+	Record(record *AuditRecord) error
+
+	/**
+	Writes record of the user action.
+	 */
+
+	RecordUser(kind string, user *AuthorizedUser, method, detail string) error
+
+	/**
+	Finds records in storage ordered by time.
+	 */
+
+	Query(ctx context.Context, query *AuditQuery) ([]*AuditRecord, error)
+}
+
+type AuditQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Username string
+	Kind     string
+
+	/**
+	Method prefix, for example '/app.UserService/'.
+	 */
+
+	Method string
+
+	/**
+	Maximum number of records, latest are returned, default 100.
+	 */
+
+	Limit int
+}
+
+type implAuditLog struct {
+	storage   store.DataStore
+	retention time.Duration
+	nodeId    uint64
+	clock     MonotonicClock
+
+	fileLock sync.Mutex
+	file     io.Writer
+}
+
+/**
+Creates audit log, file and storage are optional. File receives JSON line per record.
+Node id makes record keys unique across the cluster.
+ */
+
+func NewAuditLog(storage store.DataStore, file io.Writer, nodeId uint64, retention time.Duration) AuditLog {
+	return &implAuditLog{
+		storage:   storage,
+		retention: retention,
+		nodeId:    nodeId,
+		clock:     NewMonotonicClock(DefaultMaxClockSkew),
+		file:      file,
+	}
+}
+
+func (t *implAuditLog) Record(record *AuditRecord) error {
+
+	timestamp, seq := t.clock.Next()
+	if record.Time == 0 {
+		record.Time = timestamp
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+
+	if t.file != nil {
+		t.fileLock.Lock()
+		_, err = t.file.Write(append(value, '\n'))
+		t.fileLock.Unlock()
+		if err != nil {
+			lastErr = errors.Errorf("write audit file, %v", err)
+		}
+	}
+
+	if t.storage != nil {
+		ttlSeconds := store.NoTTL
+		if t.retention > 0 {
+			ttlSeconds = int(t.retention / time.Second)
+		}
+		key := AuditPrefix + EncodeULID(timestamp, t.nodeId, seq)
+		if err := SetWithTtl(context.Background(), t.storage, []byte(key), value, ttlSeconds); err != nil {
+			lastErr = errors.Errorf("store audit record, %v", err)
+		}
+	}
+
+	return lastErr
+}
+
+func (t *implAuditLog) RecordUser(kind string, user *AuthorizedUser, method, detail string) error {
+	record := &AuditRecord{
+		Kind:   kind,
+		Method: method,
+		Detail: detail,
+	}
+	if user != nil {
+		record.Username = user.Username
+		record.Roles = userRoles(user)
+	}
+	return t.Record(record)
+}
+
+func (t *implAuditLog) Query(ctx context.Context, query *AuditQuery) ([]*AuditRecord, error) {
+
+	if t.storage == nil {
+		return nil, errors.New("audit storage is not configured")
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	// latest records first, filter by key time, because Time field could be set by caller
+	seek := append([]byte(AuditPrefix), 0xFF)
+	until := int64(math.MaxInt64)
+	if !query.Until.IsZero() {
+		until = query.Until.UnixMilli()
+		seek = []byte(AuditPrefix + EncodeULID(until, math.MaxUint64, 0xFFFF))
+	}
+
+	var since int64
+	if !query.Since.IsZero() {
+		since = query.Since.UnixMilli()
+	}
+
+	var list []*AuditRecord
+	err := t.storage.EnumerateRaw(ctx, []byte(AuditPrefix), seek, store.DefaultBatchSize, false, true, func(entry *store.RawEntry) bool {
+
+		timestamp, _, _, err := DecodeULID(strings.TrimPrefix(string(entry.Key), AuditPrefix))
+		if err != nil || timestamp > until {
+			return true
+		}
+		if timestamp < since {
+			return false
+		}
+
+		record := new(AuditRecord)
+		if json.Unmarshal(entry.Value, record) != nil {
+			return true
+		}
+
+		if (query.Username == "" || record.Username == query.Username) &&
+			(query.Kind == "" || record.Kind == query.Kind) &&
+			strings.HasPrefix(record.Method, query.Method) {
+			list = append(list, record)
+		}
+
+		return len(list) < limit
+	})
+	if err != nil {
+		return nil, errors.Errorf("enumerate audit records, %v", err)
+	}
+
+	// ordered by time
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+
+	return list, nil
+}
+
+func userRoles(user *AuthorizedUser) []string {
+	var roles []string
+	for role, ok := range user.Roles {
+		if ok {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+/**
+Creates unary interceptor for *grpc.Server recording authenticated calls.
+Place it after access interceptors, they record denied calls with AuditDenied kind.
+ */
+
+func AuditUnaryInterceptor(auth AuthorizationMiddleware, audit AuditLog) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		recordCall(ctx, auth, audit, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+/**
+Creates stream interceptor for *grpc.Server recording authenticated calls, latency is the duration of the stream.
+ */
+
+func AuditStreamInterceptor(auth AuthorizationMiddleware, audit AuditLog) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		recordCall(ss.Context(), auth, audit, info.FullMethod, start, err)
+		return err
+	}
+}
+
+func recordCall(ctx context.Context, auth AuthorizationMiddleware, audit AuditLog, fullMethod string, start time.Time, err error) {
+
+	user, ok := auth.UserFromContext(ctx)
+	if !ok || user == nil {
+		return
+	}
+
+	audit.Record(&AuditRecord{
+		Kind:     AuditCall,
+		Username: user.Username,
+		Roles:    userRoles(user),
+		Method:   fullMethod,
+		Code:     status.Code(err).String(),
+		Latency:  time.Since(start).Microseconds(),
+	})
+}
+
+type implAuditedConfigRepository struct {
+	ConfigRepository
+	audit AuditLog
+}
+
+/**
+Wraps ConfigRepository to record each Set to AuditLog with AuditConfigSet kind, values are not recorded because of secrets.
+ */
+
+func NewAuditedConfigRepository(config ConfigRepository, audit AuditLog) ConfigRepository {
+	return &implAuditedConfigRepository{ConfigRepository: config, audit: audit}
+}
+
+func (t *implAuditedConfigRepository) Set(key, value string) error {
+
+	err := t.ConfigRepository.Set(key, value)
+
+	detail := "set"
+	if value == "" {
+		detail = "remove"
+	}
+	if err != nil {
+		detail += ", " + err.Error()
+	}
+
+	t.audit.Record(&AuditRecord{
+		Kind:   AuditConfigSet,
+		Method: key,
+		Code:   status.Code(err).String(),
+		Detail: detail,
+	})
+	return err
+}
+
+type implAuditedApplication struct {
+	Application
+	audit AuditLog
+}
+
+/**
+Wraps Application to record Shutdown to AuditLog with AuditShutdown kind before the shutdown starts.
+ */
+
+func NewAuditedApplication(application Application, audit AuditLog) Application {
+	return &implAuditedApplication{Application: application, audit: audit}
+}
+
+func (t *implAuditedApplication) Shutdown(restart bool) {
+	t.audit.Record(&AuditRecord{
+		Kind:   AuditShutdown,
+		Method: t.Application.Name(),
+		Detail: "restart=" + strconv.FormatBool(restart),
+	})
+	t.Application.Shutdown(restart)
+}
+
+/**
+Executes audit command for AuthorizationMiddleware.ExecuteCommand:
+
+	audit [since=1h] [until=2023-01-02T15:04:05Z] [user=name] [kind=call] [method=/app.Service/] [limit=100]
+
+Since and until are durations before now or RFC3339 times.
+ */
+
+func ExecuteAuditCommand(audit AuditLog, args []string) (string, error) {
+
+	query := new(AuditQuery)
+	now := time.Now()
+
+	parseTime := func(value string) (time.Time, error) {
+		if d, err := time.ParseDuration(value); err == nil {
+			return now.Add(-d), nil
+		}
+		return time.Parse(time.RFC3339, value)
+	}
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return "", errors.Errorf("invalid audit filter '%s', expected 'name=value'", arg)
+		}
+		var err error
+		switch kv[0] {
+		case "since":
+			query.Since, err = parseTime(kv[1])
+		case "until":
+			query.Until, err = parseTime(kv[1])
+		case "user":
+			query.Username = kv[1]
+		case "kind":
+			query.Kind = kv[1]
+		case "method":
+			query.Method = kv[1]
+		case "limit":
+			query.Limit, err = strconv.Atoi(kv[1])
+		default:
+			err = errors.New("unknown filter")
+		}
+		if err != nil {
+			return "", errors.Errorf("invalid audit filter '%s', %v", arg, err)
+		}
+	}
+
+	list, err := audit.Query(context.Background(), query)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatAuditRecords(list), nil
+}
+
+func FormatAuditRecords(list []*AuditRecord) string {
+
+	var out strings.Builder
+	tw := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tKIND\tUSER\tROLES\tMETHOD\tCODE\tLATENCY\tDETAIL")
+	for _, r := range list {
+		latency := ""
+		if r.Latency > 0 {
+			latency = (time.Duration(r.Latency) * time.Microsecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			time.UnixMilli(r.Time).UTC().Format(time.RFC3339Nano),
+			r.Kind, r.Username, strings.Join(r.Roles, ","), r.Method, r.Code, latency, r.Detail)
+	}
+	tw.Flush()
+	return out.String()
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+type testConfigRepository struct {
+	ConfigRepository
+	values map[string]string
+}
+
+func (t *testConfigRepository) Set(key, value string) error {
+	t.values[key] = value
+	return nil
+}
+
+type testApplication struct {
+	Application
+	restart *bool
+}
+
+func (t testApplication) Name() string          { return "test" }
+func (t testApplication) Shutdown(restart bool) { *t.restart = restart }
+
+type testUserAuthorizationMiddleware struct {
+	AuthorizationMiddleware
+	user *AuthorizedUser
+}
+
+func (t testUserAuthorizationMiddleware) UserFromContext(ctx context.Context) (*AuthorizedUser, bool) {
+	return t.user, t.user != nil
+}
+
+func queryAudit(t *testing.T, audit AuditLog, query *AuditQuery) []*AuditRecord {
+	t.Helper()
+	list, err := audit.Query(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestAuditQuery(t *testing.T) {
+
+	audit := NewAuditLog(newTestDataStore(), nil, 1, time.Hour)
+
+	for _, name := range []string{"alice", "bob", "alice"} {
+		if err := audit.RecordUser(AuditCall, &AuthorizedUser{Username: name}, "/app.Service/Call", ""); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	list := queryAudit(t, audit, &AuditQuery{})
+	if len(list) != 3 || list[0].Time > list[1].Time || list[1].Time > list[2].Time {
+		t.Fatalf("records are not ordered by time %v", list)
+	}
+
+	if list := queryAudit(t, audit, &AuditQuery{Username: "alice"}); len(list) != 2 {
+		t.Fatalf("expected 2 records of user, got %d", len(list))
+	}
+
+	// the latest records within the limit
+	if list := queryAudit(t, audit, &AuditQuery{Limit: 1}); len(list) != 1 || list[0].Username != "alice" {
+		t.Fatalf("unexpected latest record %v", list)
+	}
+
+	if list := queryAudit(t, audit, &AuditQuery{Until: time.UnixMilli(list[0].Time)}); len(list) != 1 || list[0].Username != "alice" {
+		t.Fatalf("unexpected records until the first one %v", list)
+	}
+}
+
+func TestAuditAccessDenied(t *testing.T) {
+
+	audit := NewAuditLog(newTestDataStore(), nil, 1, time.Hour)
+	policy := NewAccessPolicy(false)
+
+	auth := testUserAuthorizationMiddleware{user: &AuthorizedUser{Username: "alice", Roles: map[string]bool{"user": true}}}
+	interceptor := AccessUnaryInterceptor(auth, policy, audit, nil)
+
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/app.Service/Admin"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if err == nil {
+		t.Fatal("call is not denied")
+	}
+
+	list := queryAudit(t, audit, &AuditQuery{Kind: AuditDenied})
+	if len(list) != 1 || list[0].Username != "alice" || list[0].Method != "/app.Service/Admin" || list[0].Code != "PermissionDenied" {
+		t.Fatalf("unexpected denial records %v", list)
+	}
+}
+
+func TestAuditAdminActions(t *testing.T) {
+
+	ds := newTestDataStore()
+	audit := NewAuditLog(ds, nil, 1, time.Hour)
+
+	config := NewAuditedConfigRepository(&testConfigRepository{values: make(map[string]string)}, audit)
+	config.Set("app.secret", "value")
+	config.Set("app.secret", "")
+
+	var restart bool
+	NewAuditedApplication(testApplication{restart: &restart}, audit).Shutdown(true)
+
+	list := NewInvalidationList(ds, audit)
+	if err := list.Invalidate(&AuthorizedUser{Username: "bob", Token: "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	records := queryAudit(t, audit, &AuditQuery{})
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	if records[0].Kind != AuditConfigSet || records[0].Method != "app.secret" || records[0].Detail != "set" || records[1].Detail != "remove" {
+		t.Fatalf("unexpected config records %v %v", records[0], records[1])
+	}
+	if records[2].Kind != AuditShutdown || !restart {
+		t.Fatalf("unexpected shutdown record %v", records[2])
+	}
+	if records[3].Kind != AuditInvalidation || records[3].Username != "bob" {
+		t.Fatalf("unexpected invalidation record %v", records[3])
+	}
+
+	// retention does not rely on native TTL
+	if removed, _ := SweepExpired(context.Background(), ds, time.Now().Add(2*time.Hour), 0); removed < 4 {
+		t.Fatalf("audit records are not expired, removed %d", removed)
+	}
+	if records := queryAudit(t, audit, &AuditQuery{}); len(records) != 0 {
+		t.Fatalf("expired records are returned %v", records)
+	}
+}
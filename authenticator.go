@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+	"reflect"
+	"strings"
+)
+
+/**
+Schemes of built-in authenticators, ApiKeyScheme is defined with ApiKeyStore.
+ */
+
+const (
+	BearerScheme = "Bearer"
+	BasicScheme  = "Basic"
+	MTLSScheme   = "mTLS"
+)
+
+/**
+Returned by Authenticator when credentials are not applicable, the next authenticator is tried.
+ */
+
+var ErrNoCredentials = errors.New("no credentials")
+
+var AuthenticatorClass = reflect.TypeOf((*Authenticator)(nil)).Elem()
+
+/**
+Bean authenticating one credential scheme, collected by AuthorizationMiddleware in order.
+ */
+
+type Authenticator interface {
+
+	/**
+	Scheme of 'Authorization' header value like 'Bearer', or transport scheme like 'mTLS'.
+	 */
+
+	Scheme() string
+
+	/**
+	Authenticates credentials after the scheme in header, credentials are empty for transport schemes.
+	Returns ErrNoCredentials if the request does not have credentials of the scheme.
+	 */
+
+	Authenticate(ctx context.Context, credentials string) (*AuthorizedUser, error)
+}
+
+type authenticatorKey struct{}
+
+/**
+Places scheme of matched authenticator in to context.
+ */
+
+func WithAuthenticator(ctx context.Context, scheme string) context.Context {
+	return context.WithValue(ctx, authenticatorKey{}, scheme)
+}
+
+/**
+Returns scheme of authenticator that authenticated the call.
+ */
+
+func AuthenticatorFromContext(ctx context.Context) (string, bool) {
+	scheme, ok := ctx.Value(authenticatorKey{}).(string)
+	return scheme, ok
+}
+
+/**
+Ordered list of authenticators used by AuthorizationMiddleware.
+ */
+
+type AuthenticatorChain struct {
+	list []Authenticator
+}
+
+func NewAuthenticatorChain(list []Authenticator) *AuthenticatorChain {
+	return &AuthenticatorChain{list: list}
+}
+
+func (t *AuthenticatorChain) Authenticators() []Authenticator {
+	return t.list
+}
+
+/**
+Authenticates 'Authorization' header value by authenticators of the scheme in order.
+Returns the user and scheme of the matched authenticator.
+ */
+
+func (t *AuthenticatorChain) AuthenticateHeader(ctx context.Context, authHeader string) (*AuthorizedUser, string, error) {
+
+	scheme, credentials := authHeader, ""
+	if i := strings.IndexByte(authHeader, ' '); i > 0 {
+		scheme, credentials = authHeader[:i], strings.TrimSpace(authHeader[i+1:])
+	}
+	if credentials == "" {
+		return nil, "", ErrNoCredentials
+	}
+
+	return t.try(ctx, credentials, func(a Authenticator) bool {
+		return strings.EqualFold(a.Scheme(), scheme)
+	})
+}
+
+/**
+Authenticates gRPC call by 'authorization' or 'x-api-key' metadata, then by transport schemes like mTLS.
+Returns the user and scheme of the matched authenticator.
+ */
+
+func (t *AuthenticatorChain) AuthenticateContext(ctx context.Context) (*AuthorizedUser, string, error) {
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, header := range md.Get("authorization") {
+			user, scheme, err := t.AuthenticateHeader(ctx, header)
+			if err != ErrNoCredentials {
+				return user, scheme, err
+			}
+		}
+		if list := md.Get(ApiKeyMetadata); len(list) > 0 && list[0] != "" {
+			user, scheme, err := t.AuthenticateHeader(ctx, ApiKeyScheme+" "+list[0])
+			if err != ErrNoCredentials {
+				return user, scheme, err
+			}
+		}
+	}
+
+	return t.try(ctx, "", func(a Authenticator) bool {
+		return a.Scheme() == MTLSScheme
+	})
+}
+
+func (t *AuthenticatorChain) try(ctx context.Context, credentials string, filter func(Authenticator) bool) (*AuthorizedUser, string, error) {
+
+	lastErr := ErrNoCredentials
+	for _, a := range t.list {
+		if !filter(a) {
+			continue
+		}
+		user, err := a.Authenticate(ctx, credentials)
+		if err == nil {
+			return user, a.Scheme(), nil
+		}
+		if err != ErrNoCredentials {
+			lastErr = err
+		}
+	}
+
+	return nil, "", lastErr
+}
+
+type implFuncAuthenticator struct {
+	scheme string
+	fn     func(ctx context.Context, credentials string) (*AuthorizedUser, error)
+}
+
+func (t *implFuncAuthenticator) Scheme() string {
+	return t.scheme
+}
+
+func (t *implFuncAuthenticator) Authenticate(ctx context.Context, credentials string) (*AuthorizedUser, error) {
+	return t.fn(ctx, credentials)
+}
+
+/**
+Creates authenticator for 'Bearer' tokens, usually by AuthorizationMiddleware.ParseToken.
+ */
+
+func NewBearerAuthenticator(parseToken func(token string) (*AuthorizedUser, error)) Authenticator {
+	return &implFuncAuthenticator{
+		scheme: BearerScheme,
+		fn: func(ctx context.Context, token string) (*AuthorizedUser, error) {
+			user, err := parseToken(token)
+			if err != nil {
+				return nil, err
+			}
+			user.Token = token
+			return user, nil
+		},
+	}
+}
+
+/**
+Creates authenticator for 'Basic' credentials checked by verify function.
+ */
+
+func NewBasicAuthenticator(verify func(username, password string) (*AuthorizedUser, error)) Authenticator {
+	return &implFuncAuthenticator{
+		scheme: BasicScheme,
+		fn: func(ctx context.Context, credentials string) (*AuthorizedUser, error) {
+			decoded, err := base64.StdEncoding.DecodeString(credentials)
+			if err != nil {
+				return nil, errors.Errorf("invalid basic credentials, %v", err)
+			}
+			i := strings.IndexByte(string(decoded), ':')
+			if i < 0 {
+				return nil, errors.New("invalid basic credentials")
+			}
+			return verify(string(decoded[:i]), string(decoded[i+1:]))
+		},
+	}
+}
+
+/**
+Creates authenticator for 'ApiKey' credentials.
+ */
+
+func NewApiKeyAuthenticator(keys ApiKeyStore) Authenticator {
+	return &implFuncAuthenticator{
+		scheme: ApiKeyScheme,
+		fn: func(ctx context.Context, key string) (*AuthorizedUser, error) {
+			return keys.Authenticate(key)
+		},
+	}
+}
+
+/**
+Creates authenticator for verified client certificates of gRPC peer.
+ */
+
+func NewMTLSAuthenticator(mapper *CertificateMapper) Authenticator {
+	return &implFuncAuthenticator{
+		scheme: MTLSScheme,
+		fn: func(ctx context.Context, _ string) (*AuthorizedUser, error) {
+			user, err := mapper.AuthenticatePeer(ctx)
+			if err == ErrNoClientCertificate {
+				return nil, ErrNoCredentials
+			}
+			return user, err
+		},
+	}
+}
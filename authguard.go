@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/**
+Properties of authentication throttling, for example:
+
+	auth.limit.ip=20/m
+	auth.limit.username=5/m:10
+	auth.limit.lockout=15m
+
+Failed attempts take tokens from per-IP and per-username buckets, empty bucket locks the key for lockout duration.
+ */
+
+const (
+	AuthLimitIpProperty       = "auth.limit.ip"
+	AuthLimitUsernameProperty = "auth.limit.username"
+	AuthLimitLockoutProperty  = "auth.limit.lockout"
+)
+
+/**
+Defaults of authentication throttling.
+ */
+
+var (
+	DefaultAuthLimitIp       = "20/m"
+	DefaultAuthLimitUsername = "5/m:10"
+	DefaultAuthLockout       = 15 * time.Minute
+)
+
+/**
+Key prefix of lockouts in storage shared by cluster nodes.
+
+	auth/lockout/{ip|user}/{key}  time in milliseconds when lockout ends
+ */
+
+const AuthLockoutPrefix = "auth/lockout/"
+
+var ErrAuthLocked = errors.New("too many failed authentication attempts, try later")
+
+/**
+Throttles failed authentication attempts in AuthorizationMiddleware.
+Empty ip or username skips the corresponding check.
+ */
+
+type AuthGuard interface {
+
+	/**
+	Returns gRPC ResourceExhausted status error if ip or username is locked.
+	 */
+
+	Check(ctx context.Context, ip, username string) error
+
+	/**
+	Registers failed attempt, locks ip or username when the bucket is empty.
+	 */
+
+	Failure(ctx context.Context, ip, username string) error
+
+	/**
+	Reports stats for Component.GetStats.
+	 */
+
+	Report(cb func(name, value string) bool)
+}
+
+type implAuthGuard struct {
+	storage  store.DataStore
+	ip       RateLimiter
+	username RateLimiter
+	lockout  time.Duration
+
+	failures int64
+	lockouts int64
+	rejected int64
+}
+
+/**
+Creates guard with limits shared by cluster nodes in storage.
+ */
+
+func NewAuthGuard(storage store.DataStore, ipLimit, usernameLimit RateLimit, lockout time.Duration) AuthGuard {
+	return &implAuthGuard{
+		storage:  storage,
+		ip:       NewStoreRateLimiter(storage, "auth-ip", ipLimit),
+		username: NewStoreRateLimiter(storage, "auth-user", usernameLimit),
+		lockout:  lockout,
+	}
+}
+
+/**
+Loads guard limits from properties, missing properties use defaults.
+ */
+
+func LoadAuthGuard(config ConfigRepository, storage store.DataStore) (AuthGuard, error) {
+
+	load := func(key, def string) (RateLimit, error) {
+		value, err := config.Get(key)
+		if err != nil || value == "" {
+			value = def
+		}
+		return ParseRateLimit(value)
+	}
+
+	ipLimit, err := load(AuthLimitIpProperty, DefaultAuthLimitIp)
+	if err != nil {
+		return nil, errors.Errorf("property '%s', %v", AuthLimitIpProperty, err)
+	}
+
+	usernameLimit, err := load(AuthLimitUsernameProperty, DefaultAuthLimitUsername)
+	if err != nil {
+		return nil, errors.Errorf("property '%s', %v", AuthLimitUsernameProperty, err)
+	}
+
+	lockout := DefaultAuthLockout
+	if value, err := config.Get(AuthLimitLockoutProperty); err == nil && value != "" {
+		if lockout, err = time.ParseDuration(value); err != nil {
+			return nil, errors.Errorf("property '%s', %v", AuthLimitLockoutProperty, err)
+		}
+	}
+
+	return NewAuthGuard(storage, ipLimit, usernameLimit, lockout), nil
+}
+
+func (t *implAuthGuard) Check(ctx context.Context, ip, username string) error {
+
+	for _, g := range t.guards(ip, username) {
+		until, err := t.lockedUntil(ctx, g.lockoutKey)
+		if err != nil {
+			return err
+		}
+		if wait := time.Until(time.UnixMilli(until)); wait > 0 {
+			atomic.AddInt64(&t.rejected, 1)
+			return status.Errorf(codes.ResourceExhausted, "%v, retry after %v", ErrAuthLocked, wait.Round(time.Second))
+		}
+	}
+
+	return nil
+}
+
+func (t *implAuthGuard) Failure(ctx context.Context, ip, username string) error {
+
+	atomic.AddInt64(&t.failures, 1)
+
+	for _, g := range t.guards(ip, username) {
+
+		allowed, _, err := g.limiter.Allow(ctx, g.key)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			until := time.Now().Add(t.lockout).UnixMilli()
+			if err := SetWithTtl(ctx, t.storage, []byte(g.lockoutKey), []byte(strconv.FormatInt(until, 10)), int(t.lockout/time.Second)+1); err != nil {
+				return errors.Errorf("store lockout, %v", err)
+			}
+			atomic.AddInt64(&t.lockouts, 1)
+		}
+	}
+
+	return nil
+}
+
+func (t *implAuthGuard) Report(cb func(name, value string) bool) {
+	if !cb("auth.failures", strconv.FormatInt(atomic.LoadInt64(&t.failures), 10)) ||
+		!cb("auth.lockouts", strconv.FormatInt(atomic.LoadInt64(&t.lockouts), 10)) {
+		return
+	}
+	cb("auth.rejected", strconv.FormatInt(atomic.LoadInt64(&t.rejected), 10))
+}
+
+/**
+Stored value is checked as well, because not all backends support TTL.
+ */
+
+func (t *implAuthGuard) lockedUntil(ctx context.Context, lockoutKey string) (int64, error) {
+	value, err := t.storage.GetRaw(ctx, []byte(lockoutKey), nil, nil, false)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	until, _ := strconv.ParseInt(string(value), 10, 64)
+	return until, nil
+}
+
+type authGuardKey struct {
+	limiter    RateLimiter
+	key        string
+	lockoutKey string
+}
+
+func (t *implAuthGuard) guards(ip, username string) []authGuardKey {
+	var list []authGuardKey
+	if ip != "" {
+		list = append(list, authGuardKey{t.ip, ip, AuthLockoutPrefix + "ip/" + ip})
+	}
+	if username != "" {
+		list = append(list, authGuardKey{t.username, username, AuthLockoutPrefix + "user/" + username})
+	}
+	return list
+}
+
+/**
+Returns IP address of gRPC peer without port.
+ */
+
+func PeerIP(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", false
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host, true
+	}
+	return addr, true
+}
@@ -0,0 +1,414 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+Portable backup format of the storage.
+
+	magic       8 bytes   "SPRINTBK"
+	version     uint16    big endian, BackupVersion
+	compression byte      1 = gzip
+	gzip stream:
+	    prefix      uvarint length + bytes, key prefix of the backup
+	    createdAt   varint, creation time in milliseconds
+	    records:
+	        entry   byte 1, uvarint key length + key, uvarint value length + value, uvarint ttl in seconds
+	        end     byte 0, uvarint number of entries
+	    checksum    32 bytes, SHA-256 of all bytes of the gzip stream before the checksum
+
+Restore verifies the whole stream before any change in the storage.
+ */
+
+const BackupVersion = 1
+
+var backupMagic = []byte("SPRINTBK")
+
+const (
+	backupCompressionGzip = 1
+
+	backupRecordEnd   = 0
+	backupRecordEntry = 1
+
+	maxBackupField = 1 << 30
+)
+
+type RestoreMode int
+
+const (
+
+	/**
+	Restores entries from backup over existing ones, keeps entries missing in the backup.
+	 */
+	RestoreMerge RestoreMode = iota
+
+	/**
+	Removes all entries with backup prefix before restore.
+	 */
+	RestoreReplace
+)
+
+func (m RestoreMode) String() string {
+	switch m {
+	case RestoreMerge:
+		return "merge"
+	case RestoreReplace:
+		return "replace"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+Parses restore mode from command line argument, empty string is merge.
+ */
+
+func ParseRestoreMode(s string) (RestoreMode, error) {
+	switch strings.ToLower(s) {
+	case "", "merge":
+		return RestoreMerge, nil
+	case "replace":
+		return RestoreReplace, nil
+	default:
+		return RestoreMerge, errors.Errorf("unknown restore mode '%s', expected 'merge' or 'replace'", s)
+	}
+}
+
+type BackupHeader struct {
+
+	/**
+	Format version.
+	 */
+
+	Version int
+
+	/**
+	Key prefix of the backup, empty for the whole storage.
+	 */
+
+	Prefix string
+
+	/**
+	Creation time of the backup in milliseconds.
+	 */
+
+	CreatedAt int64
+}
+
+/**
+Writes backup of all entries with prefix from data store in portable format.
+Returns number of written entries.
+ */
+
+func WriteBackup(ctx context.Context, ds store.DataStore, w io.Writer, prefix string) (int, error) {
+
+	var head [11]byte
+	copy(head[:], backupMagic)
+	binary.BigEndian.PutUint16(head[8:], BackupVersion)
+	head[10] = backupCompressionGzip
+
+	if _, err := w.Write(head[:]); err != nil {
+		return 0, err
+	}
+
+	gz := gzip.NewWriter(w)
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(gz, h))
+
+	writeBytes(bw, []byte(prefix))
+	writeVarint(bw, time.Now().UnixMilli())
+
+	var count int
+	err := ds.EnumerateRaw(ctx, []byte(prefix), []byte(prefix), store.DefaultBatchSize, false, false, func(entry *store.RawEntry) bool {
+		bw.WriteByte(backupRecordEntry)
+		writeBytes(bw, entry.Key)
+		writeBytes(bw, entry.Value)
+		writeUvarint(bw, uint64(entry.Ttl))
+		count++
+		return true
+	})
+	if err != nil {
+		return count, errors.Errorf("enumerate prefix '%s', %v", prefix, err)
+	}
+
+	bw.WriteByte(backupRecordEnd)
+	writeUvarint(bw, uint64(count))
+
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+
+	if _, err := gz.Write(h.Sum(nil)); err != nil {
+		return count, err
+	}
+
+	return count, gz.Close()
+}
+
+/**
+Reads backup in portable format and restores entries to data store.
+Backup is verified in the temporary file before any change in data store.
+Returns header of the backup and number of restored entries.
+ */
+
+func ReadBackup(ctx context.Context, ds store.DataStore, r io.Reader, mode RestoreMode) (*BackupHeader, int, error) {
+
+	ds, err := UnguardedDataStore(ds, StorageRestore)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	spool, err := ioutil.TempFile("", "restore-*.bin")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	header, count, err := verifyBackup(r, spool)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if mode == RestoreReplace {
+		if err := dropPrefix(ctx, ds, []byte(header.Prefix)); err != nil {
+			return header, 0, errors.Errorf("drop prefix '%s', %v", header.Prefix, err)
+		}
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return header, 0, err
+	}
+
+	br := bufio.NewReader(spool)
+	for i := 0; i < count; i++ {
+		key, value, ttl, err := readEntry(br)
+		if err != nil {
+			return header, i, err
+		}
+		if err := ds.SetRaw(ctx, key, value, ttl); err != nil {
+			return header, i, errors.Errorf("restore key '%s', %v", string(key), err)
+		}
+	}
+
+	return header, count, nil
+}
+
+/**
+Reads backup header and entries, checks checksum and copies entries to spool.
+ */
+
+func verifyBackup(r io.Reader, spool io.Writer) (*BackupHeader, int, error) {
+
+	var head [11]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, 0, errors.Errorf("read backup header, %v", err)
+	}
+
+	if !bytes.Equal(head[:8], backupMagic) {
+		return nil, 0, errors.New("invalid backup format, wrong magic")
+	}
+
+	header := &BackupHeader{
+		Version: int(binary.BigEndian.Uint16(head[8:])),
+	}
+	if header.Version > BackupVersion {
+		return nil, 0, errors.Errorf("unsupported backup version %d, expected up to %d", header.Version, BackupVersion)
+	}
+	if head[10] != backupCompressionGzip {
+		return nil, 0, errors.Errorf("unsupported backup compression %d", head[10])
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, 0, errors.Errorf("open backup stream, %v", err)
+	}
+	defer gz.Close()
+
+	hr := &hashingReader{r: bufio.NewReader(gz), h: sha256.New()}
+
+	prefix, err := readBytes(hr)
+	if err != nil {
+		return nil, 0, errors.Errorf("read backup prefix, %v", err)
+	}
+	header.Prefix = string(prefix)
+
+	if header.CreatedAt, err = binary.ReadVarint(hr); err != nil {
+		return nil, 0, errors.Errorf("read backup time, %v", err)
+	}
+
+	bw := bufio.NewWriter(spool)
+
+	var count int
+	for {
+		typ, err := hr.ReadByte()
+		if err != nil {
+			return nil, 0, errors.Errorf("read backup record, %v", err)
+		}
+		if typ == backupRecordEnd {
+			break
+		}
+		if typ != backupRecordEntry {
+			return nil, 0, errors.Errorf("invalid backup record type %d", typ)
+		}
+		key, value, ttl, err := readEntry(hr)
+		if err != nil {
+			return nil, 0, err
+		}
+		writeBytes(bw, key)
+		writeBytes(bw, value)
+		writeUvarint(bw, uint64(ttl))
+		count++
+	}
+
+	expected, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return nil, 0, errors.Errorf("read backup entries number, %v", err)
+	}
+	if expected != uint64(count) {
+		return nil, 0, errors.Errorf("backup is truncated, has %d entries instead of %d", count, expected)
+	}
+
+	sum := hr.h.Sum(nil)
+	checksum := make([]byte, len(sum))
+	if _, err := io.ReadFull(hr.r, checksum); err != nil {
+		return nil, 0, errors.Errorf("read backup checksum, %v", err)
+	}
+	if !bytes.Equal(sum, checksum) {
+		return nil, 0, errors.New("backup checksum mismatch")
+	}
+
+	// reading to the end verifies gzip trailer and rejects data after the checksum
+	if _, err := hr.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			return nil, 0, errors.New("unexpected data after backup checksum")
+		}
+		return nil, 0, errors.Errorf("read backup stream end, %v", err)
+	}
+
+	return header, count, bw.Flush()
+}
+
+func dropPrefix(ctx context.Context, ds store.DataStore, prefix []byte) error {
+
+	if manager, ok := ds.(store.DataStoreManager); ok {
+		if len(prefix) == 0 {
+			return manager.DropAll()
+		}
+		return manager.DropWithPrefix(prefix)
+	}
+
+	var keys [][]byte
+	err := ds.EnumerateRaw(ctx, prefix, prefix, store.DefaultBatchSize, true, false, func(entry *store.RawEntry) bool {
+		keys = append(keys, entry.Key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := ds.RemoveRaw(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type backupReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+/**
+Reader calculating hash of all read bytes.
+ */
+
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (t *hashingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.h.Write(p[:n])
+	return n, err
+}
+
+func (t *hashingReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func readEntry(r backupReader) (key, value []byte, ttl int, err error) {
+	if key, err = readBytes(r); err != nil {
+		err = errors.Errorf("read backup key, %v", err)
+		return
+	}
+	if value, err = readBytes(r); err != nil {
+		err = errors.Errorf("read backup value of key '%s', %v", string(key), err)
+		return
+	}
+	var n uint64
+	if n, err = binary.ReadUvarint(r); err != nil {
+		err = errors.Errorf("read backup ttl of key '%s', %v", string(key), err)
+		return
+	}
+	ttl = int(n)
+	return
+}
+
+func readBytes(r backupReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBackupField {
+		return nil, errors.Errorf("backup field length %d exceeds limit %d", n, maxBackupField)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+func writeBytes(w *bufio.Writer, b []byte) {
+	writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.Write(buf[:n])
+}
+
+func writeVarint(w *bufio.Writer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	w.Write(buf[:n])
+}
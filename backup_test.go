@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func newTestBackup(t *testing.T) []byte {
+	t.Helper()
+
+	ds := newTestDataStore()
+	ctx := context.Background()
+	ds.SetRaw(ctx, []byte("app/a"), []byte("1"), 0)
+	ds.SetRaw(ctx, []byte("app/b"), []byte{}, 0)
+	ds.SetRaw(ctx, []byte("app/c"), []byte{0, 0xff}, 60)
+	ds.SetRaw(ctx, []byte("other/d"), []byte("4"), 0)
+
+	var buf bytes.Buffer
+	count, err := WriteBackup(ctx, ds, &buf, "app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 entries in backup, got %d", count)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+
+	backup := newTestBackup(t)
+
+	ds := newTestDataStore()
+	header, count, err := ReadBackup(context.Background(), ds, bytes.NewReader(backup), RestoreMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Prefix != "app/" || header.Version != BackupVersion || count != 3 {
+		t.Fatalf("unexpected header %+v and count %d", header, count)
+	}
+
+	if string(ds.values["app/a"]) != "1" || !bytes.Equal(ds.values["app/c"], []byte{0, 0xff}) || ds.ttls["app/c"] != 60 {
+		t.Fatal("entries are not restored")
+	}
+	if _, ok := ds.values["app/b"]; !ok {
+		t.Fatal("empty value is not restored")
+	}
+	if _, ok := ds.values["other/d"]; ok {
+		t.Fatal("entry outside of prefix is restored")
+	}
+}
+
+func TestBackupMergeReplace(t *testing.T) {
+
+	backup := newTestBackup(t)
+	ctx := context.Background()
+
+	for _, mode := range []RestoreMode{RestoreMerge, RestoreReplace} {
+
+		ds := newTestDataStore()
+		ds.SetRaw(ctx, []byte("app/a"), []byte("old"), 0)
+		ds.SetRaw(ctx, []byte("app/z"), []byte("extra"), 0)
+		ds.SetRaw(ctx, []byte("other/d"), []byte("kept"), 0)
+
+		if _, _, err := ReadBackup(ctx, ds, bytes.NewReader(backup), mode); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(ds.values["app/a"]) != "1" {
+			t.Fatalf("%s: entry is not overwritten", mode)
+		}
+		if _, ok := ds.values["app/z"]; ok != (mode == RestoreMerge) {
+			t.Fatalf("%s: unexpected presence of entry missing in backup", mode)
+		}
+		if string(ds.values["other/d"]) != "kept" {
+			t.Fatalf("%s: entry outside of prefix is changed", mode)
+		}
+	}
+}
+
+func TestBackupCorruption(t *testing.T) {
+
+	backup := newTestBackup(t)
+
+	corrupted := append([]byte{}, backup...)
+	corrupted[len(corrupted)-10] ^= 0xff
+
+	cases := map[string][]byte{
+		"truncated": backup[:len(backup)-20],
+		"corrupted": corrupted,
+		"magic":     append([]byte("NOTABACK"), backup[8:]...),
+	}
+
+	for name, data := range cases {
+
+		ds := newTestDataStore()
+		ds.SetRaw(context.Background(), []byte("app/a"), []byte("old"), 0)
+
+		if _, _, err := ReadBackup(context.Background(), ds, bytes.NewReader(data), RestoreReplace); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+		if string(ds.values["app/a"]) != "old" || len(ds.values) != 1 {
+			t.Fatalf("%s: store is changed by invalid backup", name)
+		}
+	}
+}
@@ -46,12 +46,13 @@ type ControlClient interface {
 	glue.DisposableBean
 
 	/**
-		Returned status of the node.
+		Returned status of the node, including storage mode.
 	 */
 	Status() (string, error)
 
 	/**
 		Sends shutdown command with restart or not.
+		Shutdown is recorded to AuditLog with AuditShutdown kind on the node by NewAuditedApplication wrapper.
 	 */
 	Shutdown(restart bool) (string, error)
 
@@ -75,8 +76,29 @@ type ControlClient interface {
 	 */
 	StorageCommand(command string, args []string) (string, error)
 
+	/**
+		Sends auth command with arguments, like 'apikey create' or 'audit since=1h'.
+	 */
+	AuthCommand(command string, args []string) (string, error)
+
+	/**
+		Streams storage backup with prefix from the node to the writer, usually a local file of CLI.
+		Same as StorageCommand("backup", ...) but the data comes to the client instead of the node file.
+	 */
+	StorageBackup(w io.Writer, prefix string) error
+
+	/**
+		Streams storage backup from the reader to the node and restores it with mode.
+	 */
+	StorageRestore(r io.Reader, mode RestoreMode) error
+
 	/**
 		Initialize bi-directional console with defined writer and error writer streams.
 	 */
 	StorageConsole(writer io.StringWriter, errWriter io.StringWriter) error
+
+	/**
+		Sends console statements from the reader, usually a file or stdin, and stops on the first error.
+	 */
+	StorageScript(r io.Reader, writer io.StringWriter, errWriter io.StringWriter) error
 }
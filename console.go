@@ -0,0 +1,264 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+Default number of lines kept in console history.
+ */
+
+var DefaultHistoryLimit = 1000
+
+/**
+Persistent history of console commands.
+ */
+
+type ConsoleHistory interface {
+
+	/**
+	Adds line to history, skips empty lines and repeats of the last line.
+	 */
+
+	Add(line string)
+
+	/**
+	Gets all lines in history, the oldest first.
+	 */
+
+	Lines() []string
+
+	/**
+	Saves history to the file.
+	 */
+
+	Save() error
+}
+
+type implConsoleHistory struct {
+	sync.Mutex
+
+	fileName string
+	limit    int
+	lines    []string
+}
+
+/**
+Creates console history loaded from the file, usually '.{name}_history' under ApplicationDir().
+Missing file means empty history.
+ */
+
+func NewConsoleHistory(fileName string, limit int) (ConsoleHistory, error) {
+
+	t := &implConsoleHistory{
+		fileName: fileName,
+		limit:    limit,
+	}
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return t, nil
+		}
+		return nil, errors.Errorf("read history file '%s', %v", fileName, err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		t.add(unescapeHistory(line))
+	}
+
+	return t, nil
+}
+
+func (t *implConsoleHistory) Add(line string) {
+	t.Lock()
+	defer t.Unlock()
+	t.add(line)
+}
+
+func (t *implConsoleHistory) add(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(t.lines); n > 0 && t.lines[n-1] == line {
+		return
+	}
+	t.lines = append(t.lines, line)
+	if t.limit > 0 && len(t.lines) > t.limit {
+		t.lines = t.lines[len(t.lines)-t.limit:]
+	}
+}
+
+func (t *implConsoleHistory) Lines() []string {
+	t.Lock()
+	defer t.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+func (t *implConsoleHistory) Save() error {
+
+	t.Lock()
+	var out strings.Builder
+	for _, line := range t.lines {
+		out.WriteString(escapeHistory(line))
+		out.WriteByte('\n')
+	}
+	t.Unlock()
+
+	return ioutil.WriteFile(t.fileName, []byte(out.String()), 0600)
+}
+
+/**
+Multi-line statements are stored in one line of history file.
+ */
+
+func escapeHistory(line string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(line)
+}
+
+func unescapeHistory(line string) string {
+	var out strings.Builder
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped && r == 'n':
+			out.WriteByte('\n')
+			escaped = false
+		case escaped:
+			out.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+/**
+Splits console input to statements.
+
+Line ending with '\' continues on the next line, empty lines and lines starting with '#' are skipped.
+Callback receives the line number where statement begins and should return true to continue.
+ */
+
+func ScanStatements(r io.Reader, cb func(lineNum int, statement string) bool) error {
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var stmt strings.Builder
+	var lineNum, startNum int
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+
+		if stmt.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			startNum = lineNum
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			stmt.WriteString(strings.TrimSuffix(line, "\\"))
+			stmt.WriteByte('\n')
+			continue
+		}
+
+		stmt.WriteString(line)
+		s := strings.TrimSpace(stmt.String())
+		stmt.Reset()
+
+		if !cb(startNum, s) {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if stmt.Len() > 0 {
+		cb(startNum, strings.TrimSpace(stmt.String()))
+	}
+
+	return nil
+}
+
+/**
+Runs statements from reader in non-interactive mode and writes results.
+Stops on the first error and returns it with the line number.
+ */
+
+func RunScript(r io.Reader, exec func(statement string) (string, error), writer io.StringWriter, errWriter io.StringWriter) error {
+
+	var scriptErr error
+
+	err := ScanStatements(r, func(lineNum int, statement string) bool {
+		out, err := exec(statement)
+		if out != "" {
+			writer.WriteString(out)
+			if !strings.HasSuffix(out, "\n") {
+				writer.WriteString("\n")
+			}
+		}
+		if err != nil {
+			scriptErr = errors.Errorf("line %d: %v", lineNum, err)
+			errWriter.WriteString(scriptErr.Error() + "\n")
+			return false
+		}
+		return true
+	})
+
+	if err != nil {
+		return errors.Errorf("read script, %v", err)
+	}
+
+	return scriptErr
+}
+
+/**
+Completes the last word of the console line.
+The first word completes by commands, the next words by keys with prefix from callback.
+Returns sorted candidates for the whole line.
+ */
+
+func CompleteLine(line string, commands []string, keys func(prefix string) []string) []string {
+
+	head, word := "", line
+	if i := strings.LastIndexAny(line, " \t"); i >= 0 {
+		head, word = line[:i+1], line[i+1:]
+	}
+
+	var candidates []string
+	if strings.TrimSpace(head) == "" {
+		for _, cmd := range commands {
+			if strings.HasPrefix(cmd, word) {
+				candidates = append(candidates, head+cmd+" ")
+			}
+		}
+	} else if keys != nil {
+		for _, key := range keys(word) {
+			candidates = append(candidates, head+key)
+		}
+	}
+
+	sort.Strings(candidates)
+	return candidates
+}
@@ -82,6 +82,10 @@ type ConfigRepository interface {
 	If value is empty string, then the property would be removed from config storage.
 	All properties are stored in string values on backend.
 
+	If StorageService is not in normal mode, function will return ErrStorageReadOnly or ErrStorageMaintenance.
+
+	Every change is recorded to AuditLog with AuditConfigSet kind by NewAuditedConfigRepository wrapper.
+
 	In case of issue function will return error.
 	*/
 
@@ -148,10 +152,26 @@ type NodeService interface {
 
 	/**
 	Returns the node id unique number. Usually random number defined on the first startup.
+
+	Node id is stored in NodeIdentityFile under ApplicationDir() together with host fingerprint.
+	If the fingerprint does not match on startup, for example for cloned VM, the node id regenerates.
 	 */
 
 	NodeId() uint64
 
+	/**
+	Returns the host fingerprint the node id belongs to.
+	 */
+
+	Fingerprint() string
+
+	/**
+	Checks node id announced by peer, logs loud warning and returns ErrDuplicateNodeId
+	if the peer has the same node id with different or unknown host fingerprint, see SameFingerprint.
+	 */
+
+	CheckPeer(peerName string, peerNodeId uint64, peerFingerprint string) error
+
 	/**
 	Returns node is in hex format as a string. Could be used in Raft and Gossip protocols as unique node number.
 	 */
@@ -200,15 +220,49 @@ type NodeService interface {
 	/**
 	Issue random time based UUID number having node id, current timestamp and random number.
 	Perfect candidate to identity ordered events in distributed systems.
+
+	In monotonic mode enabled by 'node.monotonic' property the random number is replaced by the sequence number from MonotonicClock,
+	therefore UUIDs issued on this node are strictly increasing even within the same millisecond and after clock regressions.
 	 */
 
 	Issue() uuid.UUID
 
 	/**
-	Parses UUID issues by this service. Clock usually the random number during generation.
+	Checks if Issue works in monotonic mode.
+	 */
+
+	Monotonic() bool
+
+	/**
+	Parses UUID issues by this service. Clock usually the random number during generation or the sequence number in monotonic mode.
 	 */
 
 	Parse(uuid.UUID) (timestampMillis int64, nodeId int64, clock int)
+
+	/**
+	Issue ULID compatible string in Crockford base32 encoding having current timestamp, node id and sequence number.
+	Shorter than UUID, sortable and traceable to the node, good for public URLs.
+	 */
+
+	IssueULID() string
+
+	/**
+	Parses ULID issued by this service or any other node.
+	 */
+
+	ParseULID(id string) (timestampMillis int64, nodeId int64, clock int, err error)
+
+	/**
+	Issue 64-bit snowflake ID having timestamp since SnowflakeEpoch, lower bits of node id and sequence number.
+	 */
+
+	IssueSnowflake() int64
+
+	/**
+	Parses snowflake ID issued by this service. Node id contains only lower SnowflakeNodeBits bits.
+	 */
+
+	ParseSnowflake(id int64) (timestampMillis int64, nodeId int64, clock int)
 }
 
 type StorageConsoleStream interface {
@@ -228,8 +282,19 @@ type StorageConsoleStream interface {
 
 var StorageServiceClass = reflect.TypeOf((*StorageService)(nil)).Elem()
 
+/**
+StorageService registers SnapshotJobName job in JobService if 'storage.snapshot.schedule' property is defined, see SnapshotPolicy.
+GetStats reports the last snapshot time and size.
+GetStats also reports total keys, bytes, per-prefix counters and the largest keys from the last key space scan, see KeySpaceStats.
+The scan runs in background with 'storage.stats.rate-limit' keys per second not often than 'storage.stats.interval'.
+
+Writes with TTL update expiration index, see SetWithTtl. StorageService registers ExpirationJobName job in JobService
+with 'storage.expiration.schedule' property and reports expired keys counters by GetStats, see ExpirationStats.
+ */
+
 type StorageService interface {
 	glue.InitializingBean
+	Component
 
 	/**
 	Executes query on storage.
@@ -237,12 +302,39 @@ type StorageService interface {
 
 	ExecuteQuery(name, query string, cb func(string) bool) error
 
+	/**
+	Executes query on storage and returns typed entries with key, value, TTL and version.
+	Use NewEntryWriter to render them in the selected output format.
+	 */
+
+	ExecuteRawQuery(name, query string, cb func(entry *store.RawEntry) bool) error
+
 	/**
 	Executes command on storage.
+
+	Supports 'backup {file} [prefix]' and 'restore {file} [merge|replace]' commands with files on the node.
+	Supports 'migrate [--dry-run]' and 'migrate status' commands for Migration beans, see ApplyMigrations.
+	Supports 'stats [prefix] [depth]' command for deep rate limited key space scan, see AnalyzeKeySpace.
+	Supports 'compact [discardRatio]' command to reclaim space of removed and expired keys, see CompactStore.
+	Supports 'mode [normal|readOnly|maintenance]' command to get or set storage mode.
 	 */
 
 	ExecuteCommand(cmd string, args []string) (string, error)
 
+	/**
+	Writes backup of all entries with prefix in portable format, see WriteBackup.
+	Empty prefix means the whole storage.
+	 */
+
+	Backup(w io.Writer, prefix string) error
+
+	/**
+	Restores entries from backup in portable format, see ReadBackup.
+	Backup is verified before any change in storage.
+	 */
+
+	Restore(r io.Reader, mode RestoreMode) error
+
 	/**
 	Starts bi-directional console with embedded storage through gRPC streams.
 	 */
@@ -251,10 +343,39 @@ type StorageService interface {
 
 	/**
 	Starts bi-directional console with embedded storage.
+	Console command 'format table|json|hex' selects output format of query results.
+	Console command 'set {key} {value} [ttlSeconds]' writes value with optional TTL.
+	Console keeps persistent ConsoleHistory, completes commands and keys by Complete and supports multi-line statements, see ScanStatements.
 	 */
 
 	LocalConsole(writer io.StringWriter, errWriter io.StringWriter) error
 
+	/**
+	Completes console line by commands and key prefixes, returns candidates for the whole line.
+	 */
+
+	Complete(line string) []string
+
+	/**
+	Executes console statements from the reader in non-interactive mode, stops on the first error, see RunScript.
+	 */
+
+	ExecuteScript(r io.Reader, writer io.StringWriter, errWriter io.StringWriter) error
+
+	/**
+	Sets storage mode to stop writers during restores and migrations without application shutdown.
+	Console and ConfigRepository honor the mode, see NewGuardedDataStore.
+	Mode is reported by GetStats as 'storage.mode' and visible in the node status.
+	 */
+
+	SetMode(mode StorageMode) error
+
+	/**
+	Gets current storage mode.
+	 */
+
+	Mode() StorageMode
+
 }
 
 var JobServiceClass = reflect.TypeOf((*JobService)(nil)).Elem()
@@ -352,27 +473,48 @@ type AuthorizationMiddleware interface {
 	glue.InitializingBean
 
 	/**
-	Authenticates user by using metadata from gRPC context.
-	Places the AuthorizedUser object in to context, returns new combined context.
+	Authenticates user by using metadata from gRPC context with Authenticator beans in order, see AuthenticatorChain.
+	Accepts bearer token or API key in 'x-api-key' or 'authorization: ApiKey ...' metadata, see ApiKeyStore.
+	Without credentials in metadata the verified client certificate of mutual TLS is used, see CertificateMapper.
+	Places the AuthorizedUser object and the matched scheme in to context, returns new combined context.
+	Scheme is available by AuthenticatorFromContext.
+	Failed attempts are throttled per peer IP and username by AuthGuard, lockout returns ResourceExhausted status.
+	GetStats reports 'auth.failures', 'auth.lockouts' and 'auth.rejected' counters.
 	Runs from middleware automatically by gRPC Server on each request.
 	 */
 
 	Authenticate(ctx context.Context) (context.Context, error)
 
 	/**
-	Authenticates user by using header from HTTP/gRPC request.
+	Authenticates user by using header from HTTP/gRPC request with Authenticator beans of the header scheme.
+	Accepts 'Bearer {token}', 'Basic {credentials}' and 'ApiKey {key}' header values.
+	Failed attempts are throttled per username by AuthGuard, because the header does not have IP of the client.
 	 */
 
 	AuthenticateByHeader(authHeader string) (*AuthorizedUser, bool)
 
+	/**
+	Returns authenticators in the order of use.
+	 */
+
+	Authenticators() []Authenticator
+
 	/**
 	Gets AuthorizedUser from the Context. In case of missing of the object calls Authenticate.
 	 */
 
 	GetUser(ctx context.Context) (*AuthorizedUser, bool)
 
+	/**
+	Gets AuthorizedUser placed in to the Context by Authenticate without authentication of the call.
+	Use it in interceptors running after authentication, like access, quota and audit ones.
+	 */
+
+	UserFromContext(ctx context.Context) (*AuthorizedUser, bool)
+
 	/**
 	Checks if context has user role.
+	Prefer declarative AccessPolicy with AccessUnaryInterceptor and AccessStreamInterceptor instead of calls in each handler.
 	 */
 
 	HasUserRole(ctx context.Context, role string) bool
@@ -384,23 +526,53 @@ type AuthorizationMiddleware interface {
 	UserContext(ctx context.Context, name string) (string, bool)
 
 	/**
-	Generates JWT token for AuthorizedUser. Token field would be reset.
+	Generates JWT token for AuthorizedUser signed by the active key of SigningKeyRing. Token field would be reset.
 	 */
 
 	GenerateToken(user *AuthorizedUser) (string, error)
 
+	/**
+	Generates long-lived single-use refresh token for AuthorizedUser stored on server side, see RefreshTokenStore.
+	 */
+
+	GenerateRefreshToken(user *AuthorizedUser) (string, error)
+
+	/**
+	Uses refresh token to issue the new access token and the rotated refresh token.
+	Reuse of the rotated refresh token revokes the whole token family and returns ErrReusedRefreshToken.
+	Roles of the user are the same as on GenerateRefreshToken till the family expires or is revoked.
+	 */
+
+	RefreshToken(refresh string) (access, next string, err error)
+
 	/**
 	Parses token and returns AuthorizedUser object.
+	Token is verified by the key in 'kid' header, tokens of recently retired keys are still valid.
 	 */
 
 	ParseToken(token string) (*AuthorizedUser, error)
 
 	/**
 	Adds token to invalidate list. The next login would not be possible with it.
+	Invalidation list is persisted in storage till token expiration and propagated to all nodes, see InvalidationList.
+	Invalidation is recorded to AuditLog with AuditInvalidation kind by InvalidationList created with AuditLog.
 	 */
 
 	InvalidateToken(token string)
 
+	/**
+	Lists invalidated not expired tokens for admin.
+	 */
+
+	ListInvalidated() ([]*InvalidatedToken, error)
+
+	/**
+	Executes auth command, supports 'apikey create|list|revoke', see ExecuteApiKeyCommand,
+	and 'audit [filters]' query of AuditLog, see ExecuteAuditCommand.
+	 */
+
+	ExecuteCommand(cmd string, args []string) (string, error)
+
 }
 
 var MailServiceClass = reflect.TypeOf((*MailService)(nil)).Elem()
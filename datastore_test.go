@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bytes"
+	"context"
+	"github.com/keyvalstore/store"
+	"sort"
+	"sync"
+)
+
+/**
+In-memory data store without native TTL, keeps TTL of entries only to report them.
+ */
+
+type testDataStore struct {
+	store.DataStore
+
+	sync.Mutex
+	values   map[string][]byte
+	versions map[string]int64
+	ttls     map[string]int
+}
+
+func newTestDataStore() *testDataStore {
+	return &testDataStore{
+		values:   make(map[string][]byte),
+		versions: make(map[string]int64),
+		ttls:     make(map[string]int),
+	}
+}
+
+func (t *testDataStore) GetRaw(ctx context.Context, key []byte, ttlPtr *int, versionPtr *int64, required bool) ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+	if ttlPtr != nil {
+		*ttlPtr = t.ttls[string(key)]
+	}
+	if versionPtr != nil {
+		*versionPtr = t.versions[string(key)]
+	}
+	return t.values[string(key)], nil
+}
+
+func (t *testDataStore) SetRaw(ctx context.Context, key, value []byte, ttlSeconds int) error {
+	t.Lock()
+	defer t.Unlock()
+	t.values[string(key)] = value
+	t.versions[string(key)]++
+	t.ttls[string(key)] = ttlSeconds
+	return nil
+}
+
+func (t *testDataStore) CompareAndSetRaw(ctx context.Context, key, value []byte, ttlSeconds int, version int64) (bool, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.versions[string(key)] != version {
+		return false, nil
+	}
+	t.values[string(key)] = value
+	t.versions[string(key)]++
+	t.ttls[string(key)] = ttlSeconds
+	return true, nil
+}
+
+func (t *testDataStore) RemoveRaw(ctx context.Context, key []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.values, string(key))
+	delete(t.ttls, string(key))
+	return nil
+}
+
+func (t *testDataStore) EnumerateRaw(ctx context.Context, prefix, seek []byte, batchSize int, onlyKeys bool, reverse bool, cb func(*store.RawEntry) bool) error {
+
+	t.Lock()
+	var entries []*store.RawEntry
+	for k, v := range t.values {
+		key := []byte(k)
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		if (!reverse && bytes.Compare(key, seek) < 0) || (reverse && len(seek) > len(prefix) && bytes.Compare(key, seek) > 0) {
+			continue
+		}
+		entry := &store.RawEntry{Key: key, Ttl: t.ttls[k], Version: t.versions[k]}
+		if !onlyKeys {
+			entry.Value = v
+		}
+		entries = append(entries, entry)
+	}
+	t.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		less := bytes.Compare(entries[i].Key, entries[j].Key) < 0
+		if reverse {
+			return !less
+		}
+		return less
+	})
+
+	for _, entry := range entries {
+		if !cb(entry) {
+			break
+		}
+	}
+	return nil
+}
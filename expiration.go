@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+Name of the expiration sweeper job registered by StorageService in JobService.
+ */
+
+const ExpirationJobName = "storage-expiration"
+
+/**
+Key prefixes of the expiration index.
+
+	ttl/at/{expiresAt}/{key}  index ordered by expiration time in seconds
+	ttl/key/{key}             expiration time of the key in seconds, version and hash of the value
+
+Index works with any backend, including ones without native TTL support.
+ */
+
+const (
+	ExpirationIndexPrefix = "ttl/at/"
+	ExpirationKeyPrefix   = "ttl/key/"
+)
+
+/**
+Default discard ratio for storage compaction.
+ */
+
+var DefaultDiscardRatio = 0.5
+
+/**
+Counters of expiration sweeper reported by Component.GetStats.
+ */
+
+type ExpirationStats struct {
+	expired   int64
+	sweeps    int64
+	lastSweep int64
+}
+
+func (t *ExpirationStats) Expired() int64 {
+	return atomic.LoadInt64(&t.expired)
+}
+
+func (t *ExpirationStats) Sweeps() int64 {
+	return atomic.LoadInt64(&t.sweeps)
+}
+
+/**
+Reports stats for Component.GetStats.
+ */
+
+func (t *ExpirationStats) Report(cb func(name, value string) bool) {
+	if !cb("expiration.expired", strconv.FormatInt(atomic.LoadInt64(&t.expired), 10)) ||
+		!cb("expiration.sweeps", strconv.FormatInt(atomic.LoadInt64(&t.sweeps), 10)) {
+		return
+	}
+	if last := atomic.LoadInt64(&t.lastSweep); last > 0 {
+		cb("expiration.last", time.UnixMilli(last).UTC().Format(time.RFC3339))
+	}
+}
+
+/**
+Sets value with TTL in seconds and updates the expiration index. Zero TTL removes expiration of the key.
+Native TTL of the backend is used as well, index guarantees expiration for backends without it.
+ */
+
+func SetWithTtl(ctx context.Context, ds store.DataStore, key, value []byte, ttlSeconds int) error {
+
+	if err := ds.SetRaw(ctx, key, value, ttlSeconds); err != nil {
+		return err
+	}
+
+	if ttlSeconds <= 0 {
+		return ds.RemoveRaw(ctx, []byte(ExpirationKeyPrefix+string(key)))
+	}
+
+	return SetExpiration(ctx, ds, key, ttlSeconds)
+}
+
+/**
+Adds the current value of the key to the expiration index, used after writes with native TTL like CompareAndSetRaw.
+The key is not removed by the sweeper if it is rewritten after this call, the next write should set expiration again.
+ */
+
+func SetExpiration(ctx context.Context, ds store.DataStore, key []byte, ttlSeconds int) error {
+
+	var version int64
+	value, err := ds.GetRaw(ctx, key, nil, &version, false)
+	if err != nil || value == nil {
+		return err
+	}
+
+	expiresAt := time.Now().Unix() + int64(ttlSeconds)
+	if err := ds.SetRaw(ctx, []byte(expirationIndexKey(expiresAt, key)), nil, ttlSeconds); err != nil {
+		return err
+	}
+
+	// stale index entries of previous writes are skipped by the reverse record
+	return ds.SetRaw(ctx, []byte(ExpirationKeyPrefix+string(key)), []byte(expirationStamp(expiresAt, version, value)), ttlSeconds)
+}
+
+/**
+Removes keys expired before now by the expiration index, not more than limit keys if positive.
+Returns number of removed keys.
+ */
+
+func SweepExpired(ctx context.Context, ds store.DataStore, now time.Time, limit int) (int, error) {
+
+	type indexEntry struct {
+		indexKey  []byte
+		key       []byte
+		expiresAt int64
+	}
+
+	border := []byte(expirationIndexKey(now.Unix()+1, nil))
+
+	var list []indexEntry
+	err := ds.EnumerateRaw(ctx, []byte(ExpirationIndexPrefix), []byte(ExpirationIndexPrefix), store.DefaultBatchSize, true, false, func(entry *store.RawEntry) bool {
+		if string(entry.Key) >= string(border) {
+			return false
+		}
+		rest := strings.TrimPrefix(string(entry.Key), ExpirationIndexPrefix)
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			return true
+		}
+		expiresAt, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return true
+		}
+		list = append(list, indexEntry{
+			indexKey:  entry.Key,
+			key:       []byte(rest[i+1:]),
+			expiresAt: expiresAt,
+		})
+		return limit <= 0 || len(list) < limit
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, e := range list {
+
+		reverseKey := []byte(ExpirationKeyPrefix + string(e.key))
+		stamp, err := ds.GetRaw(ctx, reverseKey, nil, nil, false)
+		if err != nil {
+			return removed, err
+		}
+
+		// skip index entries of previous writes
+		if strings.HasPrefix(string(stamp), strconv.FormatInt(e.expiresAt, 10)+":") {
+
+			var version int64
+			value, err := ds.GetRaw(ctx, e.key, nil, &version, false)
+			if err != nil {
+				return removed, err
+			}
+
+			// remove only if the key was not rewritten after SetWithTtl, for example without TTL
+			if value != nil && string(stamp) == expirationStamp(e.expiresAt, version, value) {
+				if err := ds.RemoveRaw(ctx, e.key); err != nil {
+					return removed, err
+				}
+				removed++
+			}
+
+			if err := ds.RemoveRaw(ctx, reverseKey); err != nil {
+				return removed, err
+			}
+		}
+
+		if err := ds.RemoveRaw(ctx, e.indexKey); err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+/**
+Creates expiration sweeper job for JobService, updates stats if not nil.
+ */
+
+func NewExpirationJob(ds store.DataStore, schedule string, batchSize int, stats *ExpirationStats) *JobInfo {
+	return &JobInfo{
+		Name:     ExpirationJobName,
+		Schedule: schedule,
+		ExecutionFn: func(ctx context.Context) error {
+			removed, err := SweepExpired(ctx, ds, time.Now(), batchSize)
+			if stats != nil {
+				atomic.AddInt64(&stats.expired, int64(removed))
+				atomic.AddInt64(&stats.sweeps, 1)
+				atomic.StoreInt64(&stats.lastSweep, time.Now().UnixMilli())
+			}
+			return err
+		},
+	}
+}
+
+/**
+Compacts data store with discard ratio, used by 'compact [discardRatio]' storage command.
+Returns error if the backend does not support compaction.
+ */
+
+func CompactStore(ds store.DataStore, discardRatio float64) error {
+
+	ds, err := UnguardedDataStore(ds, StorageCompact)
+	if err != nil {
+		return err
+	}
+
+	manager, ok := ds.(store.DataStoreManager)
+	if !ok {
+		return errors.Errorf("storage '%s' does not support compaction", ds.BeanName())
+	}
+
+	if discardRatio <= 0 || discardRatio >= 1 {
+		return errors.Errorf("invalid discard ratio %v, expected value between 0 and 1", discardRatio)
+	}
+
+	return manager.Compact(discardRatio)
+}
+
+/**
+Identifies the write of the key, version is zero for backends without versions, hash covers them.
+ */
+
+func expirationStamp(expiresAt, version int64, value []byte) string {
+	hash := sha256.Sum256(value)
+	return fmt.Sprintf("%d:%d:%s", expiresAt, version, hex.EncodeToString(hash[:8]))
+}
+
+/**
+Expiration time is zero padded to keep index ordered.
+ */
+
+func expirationIndexKey(expiresAt int64, key []byte) string {
+	return fmt.Sprintf("%s%020d/%s", ExpirationIndexPrefix, expiresAt, key)
+}
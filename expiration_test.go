@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSweepExpired(t *testing.T) {
+
+	ds := newTestDataStore()
+	ctx := context.Background()
+
+	if err := SetWithTtl(ctx, ds, []byte("a"), []byte("1"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWithTtl(ctx, ds, []byte("b"), []byte("2"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// written with native TTL and registered afterwards
+	ds.CompareAndSetRaw(ctx, []byte("c"), []byte("3"), 10, 0)
+	if err := SetExpiration(ctx, ds, []byte("c"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewritten without TTL after registration
+	ds.SetRaw(ctx, []byte("b"), []byte("4"), 0)
+
+	if removed, err := SweepExpired(ctx, ds, time.Now(), 0); err != nil || removed != 0 {
+		t.Fatalf("removed %d keys before expiration, %v", removed, err)
+	}
+
+	removed, err := SweepExpired(ctx, ds, time.Now().Add(time.Minute), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || ds.values["a"] != nil || ds.values["c"] != nil || string(ds.values["b"]) != "4" {
+		t.Fatalf("unexpected sweep result %d", removed)
+	}
+	if len(ds.values) != 1 {
+		t.Fatalf("index entries are left %d", len(ds.values))
+	}
+}
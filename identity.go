@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+Error returned when peer announces the same node id from the different host.
+ */
+
+var ErrDuplicateNodeId = errors.New("duplicate node id")
+
+/**
+Known locations of the machine id, usually regenerated on VM provisioning.
+ */
+
+var machineIdFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+/**
+Fingerprint of the host without machine id and physical network interfaces, usually a container.
+Unknown fingerprint does not match any fingerprint including itself, therefore the node id regenerates on each startup
+and a peer with the same node id is always a duplicate.
+ */
+
+const UnknownFingerprint = "unknown"
+
+/**
+Persistent identity of the node stored in the application directory.
+ */
+
+type NodeIdentity struct {
+
+	/**
+	Random node id generated on the first startup.
+	 */
+
+	NodeId uint64 `json:"nodeId"`
+
+	/**
+	Host fingerprint at the time of generation.
+	 */
+
+	Fingerprint string `json:"fingerprint"`
+
+	/**
+	Creation time of the identity in milliseconds.
+	 */
+
+	CreatedAt int64 `json:"createdAt"`
+}
+
+/**
+Returns node identity file name for the node sequence number.
+ */
+
+func NodeIdentityFile(applicationDir string, nodeSeq int) string {
+	if nodeSeq == 0 {
+		return filepath.Join(applicationDir, "node.id")
+	}
+	return filepath.Join(applicationDir, fmt.Sprintf("node-%d.id", nodeSeq))
+}
+
+/**
+Name prefixes of virtual network interfaces created by containers, bridges and VPNs.
+ */
+
+var virtualInterfacePrefixes = []string{"docker", "veth", "br-", "virbr", "vnet", "vmnet", "tun", "tap", "utun", "wg", "zt", "cni", "flannel", "cali", "weave", "kube", "lxc", "lxd", "ipsec", "ppp"}
+
+/**
+Calculates host fingerprint from the machine id, or from hardware addresses of physical network interfaces if machine id is not available.
+Hostname and virtual interfaces are not used, because containers, VPNs and pod restarts change them on the same host.
+Cloned VM or copied application directory would have different fingerprint.
+Returns UnknownFingerprint if the host has neither of them.
+ */
+
+func HostFingerprint() (string, error) {
+
+	h := sha256.New()
+
+	for _, file := range machineIdFiles {
+		if id, err := ioutil.ReadFile(file); err == nil {
+			if id := strings.TrimSpace(string(id)); id != "" {
+				h.Write([]byte(id))
+				return hex.EncodeToString(h.Sum(nil)[:16]), nil
+			}
+		}
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", errors.Errorf("list network interfaces, %v", err)
+	}
+
+	var macs []string
+	for _, i := range interfaces {
+		if isPhysicalInterface(i) {
+			macs = append(macs, i.HardwareAddr.String())
+		}
+	}
+	sort.Strings(macs)
+
+	if len(macs) == 0 {
+		return UnknownFingerprint, nil
+	}
+
+	for _, mac := range macs {
+		h.Write([]byte(mac))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+/**
+On Linux physical interfaces have the device link in sysfs, other systems are filtered by name.
+ */
+
+func isPhysicalInterface(i net.Interface) bool {
+
+	if i.Flags&net.FlagLoopback != 0 || len(i.HardwareAddr) == 0 {
+		return false
+	}
+
+	name := strings.ToLower(i.Name)
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+
+	if _, err := os.Stat("/sys/class/net"); err == nil {
+		_, err := os.Stat(filepath.Join("/sys/class/net", i.Name, "device"))
+		return err == nil
+	}
+
+	return true
+}
+
+/**
+Loads node identity from the file or creates the new one.
+If the stored fingerprint does not match the host fingerprint, the identity was copied and would be regenerated.
+
+Returns identity and the flag that the new identity was generated.
+ */
+
+func LoadNodeIdentity(applicationDir string, nodeSeq int) (*NodeIdentity, bool, error) {
+
+	fingerprint, err := HostFingerprint()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return loadNodeIdentity(NodeIdentityFile(applicationDir, nodeSeq), fingerprint)
+}
+
+func loadNodeIdentity(fileName, fingerprint string) (*NodeIdentity, bool, error) {
+
+	content, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		identity := new(NodeIdentity)
+		if err := json.Unmarshal(content, identity); err != nil {
+			return nil, false, errors.Errorf("invalid node identity file '%s', %v", fileName, err)
+		}
+		if identity.NodeId != 0 && SameFingerprint(identity.Fingerprint, fingerprint) {
+			return identity, false, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, false, errors.Errorf("read node identity file '%s', %v", fileName, err)
+	}
+
+	identity, err := generateNodeIdentity(fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return identity, true, StoreNodeIdentity(fileName, identity)
+}
+
+/**
+Stores node identity in the file atomically.
+ */
+
+func StoreNodeIdentity(fileName string, identity *NodeIdentity) error {
+
+	content, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		return errors.Errorf("write node identity file '%s', %v", tmpFile, err)
+	}
+
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		os.Remove(tmpFile)
+		return errors.Errorf("rename node identity file '%s', %v", fileName, err)
+	}
+
+	return nil
+}
+
+/**
+Compares host fingerprints, UnknownFingerprint does not match anything.
+ */
+
+func SameFingerprint(a, b string) bool {
+	return a == b && a != UnknownFingerprint && a != ""
+}
+
+/**
+Checks node id and fingerprint announced by peer against local identity.
+Returns ErrDuplicateNodeId if the peer has the same node id on the different or unknown host.
+ */
+
+func CheckPeerIdentity(local *NodeIdentity, peerNodeId uint64, peerFingerprint string) error {
+	if local.NodeId == peerNodeId && !SameFingerprint(local.Fingerprint, peerFingerprint) {
+		return errors.Wrapf(ErrDuplicateNodeId, "peer with fingerprint '%s' has node id '%x'", peerFingerprint, peerNodeId)
+	}
+	return nil
+}
+
+func generateNodeIdentity(fingerprint string) (*NodeIdentity, error) {
+
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, errors.Errorf("generate node id, %v", err)
+		}
+		if nodeId := binary.BigEndian.Uint64(buf[:]); nodeId != 0 {
+			return &NodeIdentity{
+				NodeId:      nodeId,
+				Fingerprint: fingerprint,
+				CreatedAt:   time.Now().UnixMilli(),
+			}, nil
+		}
+	}
+
+}
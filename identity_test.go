@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func withMachineId(t *testing.T, id string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "machine-id")
+	if err := ioutil.WriteFile(file, []byte(id+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	prev := machineIdFiles
+	machineIdFiles = []string{file}
+	t.Cleanup(func() { machineIdFiles = prev })
+}
+
+func TestLoadNodeIdentityRegenerates(t *testing.T) {
+
+	dir := t.TempDir()
+
+	withMachineId(t, "host-a")
+	first, generated, err := LoadNodeIdentity(dir, 0)
+	if err != nil || !generated {
+		t.Fatalf("expected generated identity, %v", err)
+	}
+
+	same, generated, err := LoadNodeIdentity(dir, 0)
+	if err != nil || generated || same.NodeId != first.NodeId {
+		t.Fatalf("expected stored identity %x, got %x, %v", first.NodeId, same.NodeId, err)
+	}
+
+	// application directory copied to the other host
+	withMachineId(t, "host-b")
+	moved, generated, err := LoadNodeIdentity(dir, 0)
+	if err != nil || !generated || moved.NodeId == first.NodeId || moved.Fingerprint == first.Fingerprint {
+		t.Fatalf("expected regenerated identity, %v", err)
+	}
+
+	if other, _, _ := LoadNodeIdentity(dir, 1); other.NodeId == moved.NodeId {
+		t.Fatal("node sequence should have own identity")
+	}
+}
+
+func TestLoadNodeIdentityUnknownHost(t *testing.T) {
+
+	fileName := filepath.Join(t.TempDir(), "node.id")
+
+	first, generated, err := loadNodeIdentity(fileName, UnknownFingerprint)
+	if err != nil || !generated {
+		t.Fatalf("expected generated identity, %v", err)
+	}
+
+	// identity baked in to the image is not trusted
+	second, generated, err := loadNodeIdentity(fileName, UnknownFingerprint)
+	if err != nil || !generated || second.NodeId == first.NodeId {
+		t.Fatalf("expected regenerated identity on unknown host, %v", err)
+	}
+}
+
+func TestCheckPeerIdentity(t *testing.T) {
+
+	local := &NodeIdentity{NodeId: 42, Fingerprint: "host-a"}
+
+	cases := []struct {
+		name        string
+		nodeId      uint64
+		fingerprint string
+		duplicate   bool
+	}{
+		{"other node", 7, "host-b", false},
+		{"same host", 42, "host-a", false},
+		{"other host", 42, "host-b", true},
+		{"unknown peer", 42, UnknownFingerprint, true},
+		{"empty peer", 42, "", true},
+	}
+
+	for _, c := range cases {
+		err := CheckPeerIdentity(local, c.nodeId, c.fingerprint)
+		if errors.Is(err, ErrDuplicateNodeId) != c.duplicate {
+			t.Errorf("%s: unexpected result %v", c.name, err)
+		}
+	}
+
+	unknown := &NodeIdentity{NodeId: 42, Fingerprint: UnknownFingerprint}
+	if err := CheckPeerIdentity(unknown, 42, UnknownFingerprint); !errors.Is(err, ErrDuplicateNodeId) {
+		t.Fatalf("unknown hosts should not match, %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"github.com/pkg/errors"
+)
+
+/**
+Crockford base32 alphabet, excludes I, L, O and U letters.
+ */
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+/**
+Length of ULID string, 128 bits in 5-bit characters.
+ */
+
+const ULIDLength = 26
+
+const (
+
+	/**
+	Custom epoch for snowflake IDs, 2023-01-01T00:00:00Z in milliseconds.
+	41 bits of timestamp are enough for 69 years since the epoch.
+	 */
+	SnowflakeEpoch int64 = 1672531200000
+
+	/**
+	Number of bits for the lower part of node id in snowflake ID.
+	 */
+	SnowflakeNodeBits = 10
+
+	/**
+	Number of bits for the sequence number in snowflake ID.
+	 */
+	SnowflakeSequenceBits = 12
+
+	/**
+	Maximum sequence number in snowflake ID, use it in NewSequenceClock.
+	 */
+	MaxSnowflakeSequence = 1<<SnowflakeSequenceBits - 1
+)
+
+var crockfordDecode = func() (table [256]byte) {
+	for i := range table {
+		table[i] = 0xFF
+	}
+	for i := 0; i < len(crockfordAlphabet); i++ {
+		c := crockfordAlphabet[i]
+		table[c] = byte(i)
+		table[c|0x20] = byte(i) // lower case
+	}
+	for _, c := range "Oo" {
+		table[c] = 0
+	}
+	for _, c := range "IiLl" {
+		table[c] = 1
+	}
+	return
+}()
+
+/**
+Encodes ULID compatible string from 48 bits of timestamp, 64 bits of node id and 16 bits of sequence number.
+ */
+
+func EncodeULID(timestampMillis int64, nodeId uint64, seq int) string {
+
+	hi := uint64(timestampMillis)<<16 | nodeId>>48
+	lo := nodeId<<16 | uint64(seq&0xFFFF)
+
+	var out [ULIDLength]byte
+	for i := range out {
+		var v uint64
+		switch shift := uint(125 - 5*i); {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift > 59:
+			v = hi<<(64-shift) | lo>>shift
+		default:
+			v = lo >> shift
+		}
+		out[i] = crockfordAlphabet[v&0x1F]
+	}
+
+	return string(out[:])
+}
+
+/**
+Decodes ULID compatible string encoded by EncodeULID. Case insensitive.
+ */
+
+func DecodeULID(id string) (timestampMillis int64, nodeId int64, seq int, err error) {
+
+	if len(id) != ULIDLength {
+		err = errors.Errorf("invalid ULID '%s' length %d, expected %d", id, len(id), ULIDLength)
+		return
+	}
+
+	var hi, lo uint64
+	for i := 0; i < len(id); i++ {
+		d := crockfordDecode[id[i]]
+		if d == 0xFF {
+			err = errors.Errorf("invalid ULID '%s' character '%c' at %d", id, id[i], i)
+			return
+		}
+		if i == 0 && d > 7 {
+			err = errors.Errorf("ULID '%s' overflows 128 bits", id)
+			return
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(d)
+	}
+
+	timestampMillis = int64(hi >> 16)
+	nodeId = int64(hi<<48 | lo>>16)
+	seq = int(lo & 0xFFFF)
+	return
+}
+
+/**
+Makes snowflake ID from timestamp, lower bits of node id and sequence number.
+ */
+
+func MakeSnowflake(timestampMillis int64, nodeId uint64, seq int) int64 {
+	ts := (timestampMillis - SnowflakeEpoch) & (1<<41 - 1)
+	node := int64(nodeId & (1<<SnowflakeNodeBits - 1))
+	return ts<<(SnowflakeNodeBits+SnowflakeSequenceBits) | node<<SnowflakeSequenceBits | int64(seq&MaxSnowflakeSequence)
+}
+
+/**
+Splits snowflake ID made by MakeSnowflake.
+ */
+
+func SplitSnowflake(id int64) (timestampMillis int64, nodeId int64, seq int) {
+	timestampMillis = id>>(SnowflakeNodeBits+SnowflakeSequenceBits) + SnowflakeEpoch
+	nodeId = id >> SnowflakeSequenceBits & (1<<SnowflakeNodeBits - 1)
+	seq = int(id & MaxSnowflakeSequence)
+	return
+}
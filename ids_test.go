@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestULIDRoundTrip(t *testing.T) {
+
+	cases := []struct {
+		millis int64
+		nodeId uint64
+		seq    int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{time.Now().UnixMilli(), 0x1234567890ABCDEF, 0xABCD},
+		{1<<48 - 1, math.MaxUint64, 0xFFFF},
+	}
+
+	for _, c := range cases {
+		id := EncodeULID(c.millis, c.nodeId, c.seq)
+		if len(id) != ULIDLength {
+			t.Fatalf("invalid length of '%s'", id)
+		}
+		if id[0] > '7' {
+			t.Fatalf("first character of '%s' is greater than '7'", id)
+		}
+		millis, nodeId, seq, err := DecodeULID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if millis != c.millis || uint64(nodeId) != c.nodeId || seq != c.seq {
+			t.Fatalf("'%s' decoded to %d:%x:%d, expected %d:%x:%d", id, millis, uint64(nodeId), seq, c.millis, c.nodeId, c.seq)
+		}
+		if _, _, _, err := DecodeULID(strings.ToLower(id)); err != nil {
+			t.Fatalf("lower case '%s', %v", id, err)
+		}
+	}
+}
+
+func TestULIDSortsByTime(t *testing.T) {
+
+	start := time.Now().UnixMilli()
+
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		// node id and sequence do not affect the order of different milliseconds
+		ids = append(ids, EncodeULID(start+int64(i), uint64(1000-i), 1000-i))
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Fatal("ULIDs are not sorted by time")
+	}
+}
+
+func TestDecodeStandardULID(t *testing.T) {
+
+	// example of the ULID specification
+	millis, nodeId, seq, err := DecodeULID("01ARYZ6S41TSV4RRFFQ69G5FAV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if millis != 1469918176385 {
+		t.Fatalf("unexpected timestamp %d", millis)
+	}
+	if uint64(nodeId) != 15453623154885890818 || seq != 48475 {
+		t.Fatalf("unexpected random part %d:%d", uint64(nodeId), seq)
+	}
+
+	for _, id := range []string{"81ARYZ6S41TSV4RRFFQ69G5FAV", "01ARYZ6S41TSV4RRFFQ69G5FA", "01ARYZ6S41TSV4RRFFQ69G5FAU"} {
+		if _, _, _, err := DecodeULID(id); err == nil {
+			t.Fatalf("expected error for '%s'", id)
+		}
+	}
+}
+
+func TestSnowflakeRoundTrip(t *testing.T) {
+
+	now := time.Now().UnixMilli()
+
+	cases := []struct {
+		millis int64
+		nodeId uint64
+		seq    int
+	}{
+		{SnowflakeEpoch, 0, 0},
+		{now, 1, 1},
+		{now, 1<<SnowflakeNodeBits - 1, MaxSnowflakeSequence},
+	}
+
+	for _, c := range cases {
+		millis, nodeId, seq := SplitSnowflake(MakeSnowflake(c.millis, c.nodeId, c.seq))
+		if millis != c.millis || uint64(nodeId) != c.nodeId || seq != c.seq {
+			t.Fatalf("snowflake %d:%d:%d, expected %d:%d:%d", millis, nodeId, seq, c.millis, c.nodeId, c.seq)
+		}
+	}
+
+	// only the lower bits of node id are kept
+	if _, nodeId, _ := SplitSnowflake(MakeSnowflake(now, 1<<SnowflakeNodeBits+5, 0)); nodeId != 5 {
+		t.Fatalf("unexpected node id %d", nodeId)
+	}
+
+	if MakeSnowflake(now, 1023, MaxSnowflakeSequence) >= MakeSnowflake(now+1, 0, 0) {
+		t.Fatal("snowflake IDs are not ordered by time")
+	}
+}
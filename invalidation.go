@@ -0,0 +1,297 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Key prefix of invalidated tokens in storage shared by cluster nodes.
+
+	auth/invalid/{sha256 of token}  invalidated token record, expires with the token
+ */
+
+const TokenInvalidationPrefix = "auth/invalid/"
+
+/**
+Interval of removal of expired tokens from the local list, checked on lookups.
+ */
+
+var InvalidationPruneInterval = time.Minute
+
+type InvalidatedToken struct {
+
+	/**
+	Hex of sha256 of the token, the token itself is not stored.
+	 */
+
+	Hash string `json:"hash"`
+
+	Username string `json:"username,omitempty"`
+
+	/**
+	Time in milliseconds when token expires and record is removed.
+	 */
+
+	ExpiresAt int64 `json:"expiresAt"`
+
+	/**
+	Time in milliseconds of invalidation.
+	 */
+
+	InvalidatedAt int64 `json:"invalidatedAt"`
+}
+
+/**
+Persistent list of invalidated tokens used by AuthorizationMiddleware.
+Records expire at token ExpiresAt, because expired tokens are rejected anyway.
+ */
+
+type InvalidationList interface {
+
+	/**
+	Stores invalidated token and adds it to the local list.
+	 */
+
+	Invalidate(user *AuthorizedUser) error
+
+	/**
+	Checks token in the local list without storage access, expired tokens are pruned from the list on the way.
+	 */
+
+	IsInvalidated(token string) bool
+
+	/**
+	Lists invalidated tokens from storage ordered by invalidation time.
+	 */
+
+	List() ([]*InvalidatedToken, error)
+
+	/**
+	Merges records from storage in to the local list, removes expired records.
+	 */
+
+	Sync(ctx context.Context) error
+
+	/**
+	Syncs the list and watches TokenInvalidationPrefix to propagate invalidations of other nodes during active context.
+	Storage of the list should be the backend of ConfigRepository.
+	 */
+
+	Watch(ctx context.Context, config ConfigRepository) (context.CancelFunc, error)
+}
+
+type implInvalidationList struct {
+	storage store.DataStore
+	audit   AuditLog
+
+	sync.RWMutex
+	tokens map[string]int64
+
+	// time in milliseconds of the next prune
+	pruneAt int64
+}
+
+/**
+Creates invalidation list over storage, audit is optional to record invalidations with AuditInvalidation kind.
+ */
+
+func NewInvalidationList(storage store.DataStore, audit AuditLog) InvalidationList {
+	return &implInvalidationList{
+		storage: storage,
+		audit:   audit,
+		tokens:  make(map[string]int64),
+	}
+}
+
+func (t *implInvalidationList) Invalidate(user *AuthorizedUser) error {
+
+	if user.Token == "" {
+		return errors.New("empty token")
+	}
+
+	now := time.Now().UnixMilli()
+	if user.ExpiresAt > 0 && user.ExpiresAt <= now {
+		// expired token does not need invalidation
+		return nil
+	}
+
+	record := &InvalidatedToken{
+		Hash:          tokenHash(user.Token),
+		Username:      user.Username,
+		ExpiresAt:     user.ExpiresAt,
+		InvalidatedAt: now,
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ttlSeconds := store.NoTTL
+	if user.ExpiresAt > 0 {
+		ttlSeconds = int((user.ExpiresAt-now)/1000) + 1
+	}
+
+	if err := SetWithTtl(context.Background(), t.storage, []byte(TokenInvalidationPrefix+record.Hash), value, ttlSeconds); err != nil {
+		return errors.Errorf("store invalidated token, %v", err)
+	}
+
+	t.Lock()
+	t.tokens[record.Hash] = record.ExpiresAt
+	t.Unlock()
+
+	if t.audit != nil {
+		// prefix of the hash identifies the record in List, the token itself is not recorded
+		t.audit.RecordUser(AuditInvalidation, user, "", "token "+record.Hash[:16])
+	}
+	return nil
+}
+
+func (t *implInvalidationList) IsInvalidated(token string) bool {
+
+	now := time.Now().UnixMilli()
+
+	t.RLock()
+	expiresAt, ok := t.tokens[tokenHash(token)]
+	prune := now >= t.pruneAt
+	t.RUnlock()
+
+	if prune {
+		t.Lock()
+		t.prune(now)
+		t.Unlock()
+	}
+
+	return ok && (expiresAt == 0 || expiresAt > now)
+}
+
+func (t *implInvalidationList) List() ([]*InvalidatedToken, error) {
+	list, err := t.load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].InvalidatedAt < list[j].InvalidatedAt
+	})
+	return list, nil
+}
+
+func (t *implInvalidationList) Sync(ctx context.Context) error {
+
+	list, err := t.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+
+	t.Lock()
+	defer t.Unlock()
+
+	// keep local invalidations not visible in storage yet
+	for _, record := range list {
+		t.tokens[record.Hash] = record.ExpiresAt
+	}
+
+	t.prune(now)
+	return nil
+}
+
+/**
+Removes expired tokens, caller holds the lock.
+ */
+
+func (t *implInvalidationList) prune(now int64) {
+	for hash, expiresAt := range t.tokens {
+		if expiresAt > 0 && expiresAt <= now {
+			delete(t.tokens, hash)
+		}
+	}
+	t.pruneAt = now + InvalidationPruneInterval.Milliseconds()
+}
+
+func (t *implInvalidationList) Watch(ctx context.Context, config ConfigRepository) (context.CancelFunc, error) {
+
+	cancel, err := config.Watch(ctx, TokenInvalidationPrefix, func(key, value string) bool {
+
+		if value == "" {
+			t.Lock()
+			delete(t.tokens, strings.TrimPrefix(key, TokenInvalidationPrefix))
+			t.Unlock()
+			return true
+		}
+
+		record := new(InvalidatedToken)
+		if json.Unmarshal([]byte(value), record) != nil {
+			return true
+		}
+		if record.Hash == "" {
+			record.Hash = strings.TrimPrefix(key, TokenInvalidationPrefix)
+		}
+
+		t.Lock()
+		t.tokens[record.Hash] = record.ExpiresAt
+		t.Unlock()
+		return true
+	})
+	if err != nil {
+		return nil, errors.Errorf("watch invalidated tokens, %v", err)
+	}
+
+	// invalidations before the watch
+	if err := t.Sync(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return cancel, nil
+}
+
+/**
+Loads not expired records, backends without native TTL may still return expired ones.
+ */
+
+func (t *implInvalidationList) load(ctx context.Context) ([]*InvalidatedToken, error) {
+
+	now := time.Now().UnixMilli()
+	var list []*InvalidatedToken
+
+	err := t.storage.EnumerateRaw(ctx, []byte(TokenInvalidationPrefix), []byte(TokenInvalidationPrefix), store.DefaultBatchSize, false, false, func(entry *store.RawEntry) bool {
+		record := new(InvalidatedToken)
+		if json.Unmarshal(entry.Value, record) != nil {
+			// skip foreign records
+			return true
+		}
+		if record.Hash == "" {
+			record.Hash = strings.TrimPrefix(string(entry.Key), TokenInvalidationPrefix)
+		}
+		if record.ExpiresAt == 0 || record.ExpiresAt > now {
+			list = append(list, record)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Errorf("enumerate invalidated tokens, %v", err)
+	}
+
+	return list, nil
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInvalidationListPrunesOnLookup(t *testing.T) {
+
+	list := NewInvalidationList(newTestDataStore(), nil).(*implInvalidationList)
+
+	expiresAt := time.Now().Add(100 * time.Millisecond).UnixMilli()
+	if err := list.Invalidate(&AuthorizedUser{Username: "alice", Token: "short", ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Invalidate(&AuthorizedUser{Username: "alice", Token: "long"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !list.IsInvalidated("short") || !list.IsInvalidated("long") || list.IsInvalidated("other") {
+		t.Fatal("unexpected lookup result")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	list.pruneAt = 0
+
+	// lookup of the other token prunes the expired one without Sync
+	if !list.IsInvalidated("long") {
+		t.Fatal("token without expiration is pruned")
+	}
+	if n := len(list.tokens); n != 1 {
+		t.Fatalf("expired token is not pruned, %d tokens", n)
+	}
+
+	// the other node sees only not expired records
+	other := NewInvalidationList(list.storage, nil)
+	if err := other.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if other.IsInvalidated("short") || !other.IsInvalidated("long") {
+		t.Fatal("unexpected result after sync")
+	}
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"github.com/keyvalstore/store"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type KeySpaceOptions struct {
+
+	/**
+	Key prefix to scan, empty for the whole storage.
+	 */
+
+	Prefix string
+
+	/**
+	Separator of key segments, default '/'.
+	 */
+
+	Separator string
+
+	/**
+	Number of key segments in per-prefix counters, default 1.
+	 */
+
+	Depth int
+
+	/**
+	Number of the largest keys to report, default 10.
+	 */
+
+	TopKeys int
+
+	/**
+	Maximum number of scanned keys per second, zero means unlimited.
+	Use limit on production nodes to not affect the load.
+	 */
+
+	RateLimit int
+}
+
+type PrefixStats struct {
+	Prefix string
+	Keys   int64
+	Bytes  int64
+}
+
+type KeySize struct {
+	Key  string
+	Size int
+}
+
+type KeySpaceStats struct {
+
+	/**
+	Total number of keys.
+	 */
+
+	Keys int64
+
+	/**
+	Total size of keys and values in bytes.
+	 */
+
+	Bytes int64
+
+	/**
+	Counters by key prefix ordered by size descending.
+	 */
+
+	Prefixes []PrefixStats
+
+	/**
+	The largest entries ordered by size descending.
+	 */
+
+	Largest []KeySize
+
+	/**
+	Time of the scan completion and its duration.
+	 */
+
+	ScannedAt time.Time
+	Duration  time.Duration
+}
+
+/**
+Scans key space of data store and collects statistics.
+Scan stops with context error if context is done.
+ */
+
+func AnalyzeKeySpace(ctx context.Context, ds store.DataStore, opts KeySpaceOptions) (*KeySpaceStats, error) {
+
+	if opts.Separator == "" {
+		opts.Separator = "/"
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = 1
+	}
+	if opts.TopKeys <= 0 {
+		opts.TopKeys = 10
+	}
+
+	start := time.Now()
+	stats := new(KeySpaceStats)
+	prefixes := make(map[string]*PrefixStats)
+	largest := &keySizeHeap{}
+
+	batchSize := store.DefaultBatchSize
+	if opts.RateLimit > 0 && opts.RateLimit < batchSize {
+		batchSize = opts.RateLimit
+	}
+
+	// scan by batches and pause between them, iterator is closed while waiting
+	seek := []byte(opts.Prefix)
+	for {
+
+		var scanned int
+		var lastKey []byte
+
+		err := ds.EnumerateRaw(ctx, []byte(opts.Prefix), seek, batchSize, false, false, func(entry *store.RawEntry) bool {
+
+			size := len(entry.Key) + len(entry.Value)
+			stats.Keys++
+			stats.Bytes += int64(size)
+
+			p := keyPrefix(string(entry.Key), opts.Separator, opts.Depth)
+			ps, ok := prefixes[p]
+			if !ok {
+				ps = &PrefixStats{Prefix: p}
+				prefixes[p] = ps
+			}
+			ps.Keys++
+			ps.Bytes += int64(size)
+
+			if largest.Len() < opts.TopKeys {
+				heap.Push(largest, KeySize{Key: string(entry.Key), Size: size})
+			} else if (*largest)[0].Size < size {
+				(*largest)[0] = KeySize{Key: string(entry.Key), Size: size}
+				heap.Fix(largest, 0)
+			}
+
+			lastKey = append(lastKey[:0], entry.Key...)
+			scanned++
+			return scanned < batchSize && ctx.Err() == nil
+		})
+
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if scanned < batchSize {
+			break
+		}
+
+		// the next key after the last scanned one
+		seek = append(lastKey, 0)
+
+		if opts.RateLimit > 0 {
+			expected := time.Duration(stats.Keys) * time.Second / time.Duration(opts.RateLimit)
+			if pause := expected - time.Since(start); pause > 0 {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(pause):
+				}
+			}
+		}
+	}
+
+	for _, ps := range prefixes {
+		stats.Prefixes = append(stats.Prefixes, *ps)
+	}
+	sort.Slice(stats.Prefixes, func(i, j int) bool {
+		if stats.Prefixes[i].Bytes == stats.Prefixes[j].Bytes {
+			return stats.Prefixes[i].Prefix < stats.Prefixes[j].Prefix
+		}
+		return stats.Prefixes[i].Bytes > stats.Prefixes[j].Bytes
+	})
+
+	stats.Largest = *largest
+	sort.Slice(stats.Largest, func(i, j int) bool {
+		return stats.Largest[i].Size > stats.Largest[j].Size
+	})
+
+	stats.ScannedAt = time.Now()
+	stats.Duration = stats.ScannedAt.Sub(start)
+	return stats, nil
+}
+
+/**
+Reports stats for Component.GetStats with 'storage.' prefix in names.
+ */
+
+func (t *KeySpaceStats) Report(cb func(name, value string) bool) {
+
+	if !cb("storage.keys", strconv.FormatInt(t.Keys, 10)) ||
+		!cb("storage.bytes", strconv.FormatInt(t.Bytes, 10)) ||
+		!cb("storage.scanned", t.ScannedAt.UTC().Format(time.RFC3339)) {
+		return
+	}
+
+	for _, ps := range t.Prefixes {
+		if !cb("storage.prefix."+ps.Prefix+".keys", strconv.FormatInt(ps.Keys, 10)) ||
+			!cb("storage.prefix."+ps.Prefix+".bytes", strconv.FormatInt(ps.Bytes, 10)) {
+			return
+		}
+	}
+
+	for i, ks := range t.Largest {
+		if !cb(fmt.Sprintf("storage.largest.%d", i+1), fmt.Sprintf("%s %d", printable([]byte(ks.Key), 0), ks.Size)) {
+			return
+		}
+	}
+
+}
+
+/**
+Formats stats as text for 'stats' storage command.
+ */
+
+func (t *KeySpaceStats) Format() string {
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "keys: %d\nbytes: %d\nduration: %v\n\n", t.Keys, t.Bytes, t.Duration)
+
+	tw := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tKEYS\tBYTES")
+	for _, ps := range t.Prefixes {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", ps.Prefix, ps.Keys, ps.Bytes)
+	}
+	tw.Flush()
+
+	out.WriteString("\n")
+
+	tw = tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LARGEST KEY\tBYTES")
+	for _, ks := range t.Largest {
+		fmt.Fprintf(tw, "%s\t%d\n", printable([]byte(ks.Key), 0), ks.Size)
+	}
+	tw.Flush()
+
+	return out.String()
+}
+
+/**
+Prefix name for keys without separator.
+ */
+
+const noKeyPrefix = "(none)"
+
+/**
+Returns the first depth segments of the key including separators.
+ */
+
+func keyPrefix(key, sep string, depth int) string {
+	pos := 0
+	for i := 0; i < depth; i++ {
+		n := strings.Index(key[pos:], sep)
+		if n < 0 {
+			if i == 0 {
+				return noKeyPrefix
+			}
+			break
+		}
+		pos += n + len(sep)
+	}
+	return printable([]byte(key[:pos]), 0)
+}
+
+/**
+Min-heap by size to keep the largest keys.
+ */
+
+type keySizeHeap []KeySize
+
+func (h keySizeHeap) Len() int           { return len(h) }
+func (h keySizeHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h keySizeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keySizeHeap) Push(x interface{}) {
+	*h = append(*h, x.(KeySize))
+}
+
+func (h *keySizeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
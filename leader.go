@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/codeallergy/glue"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var LeaderElectionClass = reflect.TypeOf((*LeaderElection)(nil)).Elem()
+
+type LeaderChange struct {
+
+	/**
+	Node id in hex format of the current leader, empty if there is no leader.
+	 */
+
+	Leader string
+
+	/**
+	Flag indicates that the local node is the leader.
+	 */
+
+	IsLeader bool
+}
+
+/**
+Leader election selects exactly one node of the application to perform maintenance tasks.
+ */
+
+type LeaderElection interface {
+	glue.InitializingBean
+	glue.DisposableBean
+	Component
+
+	/**
+	Checks if the local node is the leader.
+	 */
+
+	IsLeader() bool
+
+	/**
+	Gets node id in hex format of the current leader if known.
+	 */
+
+	Leader() (string, bool)
+
+	/**
+	Subscribes on leadership changes during specific active context.
+	The channel receives the current state immediately and the latest state on each change, closes when context is done.
+
+	Use Application as context.
+	 */
+
+	Subscribe(ctx context.Context) <-chan LeaderChange
+
+	/**
+	Releases leadership if the local node is the leader and stops campaigning.
+	 */
+
+	Resign() error
+
+	/**
+	Resumes campaigning after Resign, returns true if the local node became the leader.
+	 */
+
+	Campaign() bool
+}
+
+type implStoreLeaderElection struct {
+	Application      Application      `inject:""`
+	NodeService      NodeService      `inject:""`
+	ConfigRepository ConfigRepository `inject:""`
+
+	/**
+	Lease time in seconds, the leader renews it each third part of the lease.
+	 */
+	LeaseSeconds int `value:"leader.lease,default=15"`
+
+	/**
+	Election name, by default application name. Nodes with the same election name compete for the leadership.
+	 */
+	Election string `value:"leader.election,default="`
+
+	storage store.DataStore
+	key     string
+	self    string
+
+	closeOnce sync.Once
+	shutdown  chan struct{}
+	wg        sync.WaitGroup
+
+	mu          sync.Mutex
+	state       LeaderChange
+	resigned    bool
+	subscribers map[chan LeaderChange]bool
+}
+
+type leaderLease struct {
+	Leader    string `json:"leader"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+/**
+Creates lease based leader election over the ConfigRepository backend store.
+The lease is stored under 'leader/{election}' key with TTL, the value holds node id in hex format and expiration time,
+so the lease of crashed leader is free on backends without native TTL.
+ */
+
+func NewStoreLeaderElection() LeaderElection {
+	return &implStoreLeaderElection{
+		shutdown:    make(chan struct{}),
+		subscribers: make(map[chan LeaderChange]bool),
+	}
+}
+
+func (t *implStoreLeaderElection) BeanName() string {
+	return "leader"
+}
+
+func (t *implStoreLeaderElection) PostConstruct() error {
+
+	t.storage = t.ConfigRepository.Backend()
+	if t.storage == nil {
+		return errors.New("leader election needs ConfigRepository backend store")
+	}
+
+	if t.LeaseSeconds < 3 {
+		t.LeaseSeconds = 3
+	}
+
+	if t.Election == "" {
+		t.Election = t.Application.Name()
+	}
+
+	t.key = "leader/" + t.Election
+	t.self = t.NodeService.NodeIdHex()
+
+	t.wg.Add(1)
+	go t.campaignLoop()
+
+	return nil
+}
+
+func (t *implStoreLeaderElection) Destroy() error {
+	err := t.Resign()
+	t.closeOnce.Do(func() {
+		close(t.shutdown)
+	})
+	t.wg.Wait()
+	return err
+}
+
+func (t *implStoreLeaderElection) GetStats(cb func(name, value string) bool) error {
+	t.mu.Lock()
+	state := t.state
+	t.mu.Unlock()
+
+	cb("leader.election", t.Election)
+	cb("leader.node", state.Leader)
+	cb("leader.local", strconv.FormatBool(state.IsLeader))
+	return nil
+}
+
+func (t *implStoreLeaderElection) IsLeader() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.IsLeader
+}
+
+func (t *implStoreLeaderElection) Leader() (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.Leader, t.state.Leader != ""
+}
+
+func (t *implStoreLeaderElection) Subscribe(ctx context.Context) <-chan LeaderChange {
+
+	ch := make(chan LeaderChange, 1)
+
+	t.mu.Lock()
+	ch <- t.state
+	t.subscribers[ch] = true
+	t.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-t.shutdown:
+		}
+		t.mu.Lock()
+		if t.subscribers[ch] {
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+		t.mu.Unlock()
+	}()
+
+	return ch
+}
+
+func (t *implStoreLeaderElection) Resign() error {
+
+	t.mu.Lock()
+	if t.resigned {
+		t.mu.Unlock()
+		return nil
+	}
+	t.resigned = true
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.renewInterval())
+	defer cancel()
+
+	var version int64
+	value, err := t.storage.GetRaw(ctx, []byte(t.key), nil, &version, false)
+	if err == nil {
+		if lease, ok := parseLeaderLease(value); ok && lease.Leader == t.self {
+			// empty value means free lease, short TTL cleans up the record
+			_, err = t.storage.CompareAndSetRaw(ctx, []byte(t.key), []byte{}, 1, version)
+		}
+	}
+
+	t.setState(LeaderChange{})
+
+	if err != nil {
+		return errors.Errorf("leader resign '%s', %v", t.key, err)
+	}
+	return nil
+}
+
+func (t *implStoreLeaderElection) Campaign() bool {
+
+	t.mu.Lock()
+	t.resigned = false
+	t.mu.Unlock()
+
+	t.campaign()
+	return t.IsLeader()
+}
+
+/**
+Parses the lease record, empty or corrupted record is a free lease, CAS on version protects from concurrent campaigns.
+ */
+
+func parseLeaderLease(value []byte) (*leaderLease, bool) {
+	if len(value) == 0 {
+		return nil, false
+	}
+	lease := new(leaderLease)
+	if err := json.Unmarshal(value, lease); err != nil || lease.Leader == "" {
+		return nil, false
+	}
+	return lease, true
+}
+
+func (t *implStoreLeaderElection) renewInterval() time.Duration {
+	return time.Duration(t.LeaseSeconds) * time.Second / 3
+}
+
+func (t *implStoreLeaderElection) campaignLoop() {
+
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.renewInterval())
+	defer ticker.Stop()
+
+	for {
+
+		t.mu.Lock()
+		resigned := t.resigned
+		t.mu.Unlock()
+
+		if !resigned {
+			t.campaign()
+		}
+
+		select {
+		case <-t.shutdown:
+			return
+		case <-t.Application.Done():
+			// release leadership as soon as application starts shutting down
+			t.Resign()
+			return
+		case <-ticker.C:
+		}
+	}
+
+}
+
+func (t *implStoreLeaderElection) campaign() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.renewInterval())
+	defer cancel()
+
+	var version int64
+	value, err := t.storage.GetRaw(ctx, []byte(t.key), nil, &version, false)
+	if err != nil {
+		// step down if the lease can not be verified
+		t.setState(LeaderChange{})
+		return
+	}
+
+	now := time.Now()
+
+	lease, ok := parseLeaderLease(value)
+	if ok && lease.Leader != t.self && lease.ExpiresAt > now.UnixMilli() {
+		t.setState(LeaderChange{Leader: lease.Leader})
+		return
+	}
+
+	// acquire free or expired lease or renew own one, version protects from concurrent campaigns
+	value, err = json.Marshal(&leaderLease{Leader: t.self, ExpiresAt: now.Add(time.Duration(t.LeaseSeconds) * time.Second).UnixMilli()})
+	if err != nil {
+		t.setState(LeaderChange{})
+		return
+	}
+
+	ok, err = t.storage.CompareAndSetRaw(ctx, []byte(t.key), value, t.LeaseSeconds, version)
+	if err != nil || !ok {
+		t.setState(LeaderChange{})
+		return
+	}
+
+	t.setState(LeaderChange{Leader: t.self, IsLeader: true})
+}
+
+func (t *implStoreLeaderElection) setState(state LeaderChange) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == state {
+		return
+	}
+	t.state = state
+
+	for ch := range t.subscribers {
+		// keep only the latest state for slow subscribers
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- state
+	}
+
+}
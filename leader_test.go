@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+/**
+Election without campaign loop, tests call campaign directly on the store without native TTL.
+ */
+
+func newTestLeaderElection(ds *testDataStore, nodeId uint64) *implStoreLeaderElection {
+	t := NewStoreLeaderElection().(*implStoreLeaderElection)
+	t.NodeService = &testNodeService{nodeId: nodeId}
+	t.LeaseSeconds = 3
+	t.Election = "test"
+	t.storage = ds
+	t.key = "leader/test"
+	t.self = t.NodeService.NodeIdHex()
+	return t
+}
+
+func TestLeaderAcquireRenew(t *testing.T) {
+
+	ds := newTestDataStore()
+	a := newTestLeaderElection(ds, 1)
+	b := newTestLeaderElection(ds, 2)
+
+	changes := a.Subscribe(context.Background())
+	if change := <-changes; change.IsLeader {
+		t.Fatal("leader before campaign")
+	}
+
+	a.campaign()
+	b.campaign()
+
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatal("expected the first node as the leader")
+	}
+	if leader, ok := b.Leader(); !ok || leader != a.self {
+		t.Fatalf("unexpected leader '%s'", leader)
+	}
+	if change := <-changes; !change.IsLeader || change.Leader != a.self {
+		t.Fatalf("unexpected change %+v", change)
+	}
+
+	// renew extends the lease
+	var lease leaderLease
+	json.Unmarshal(ds.values[a.key], &lease)
+	time.Sleep(5 * time.Millisecond)
+	a.campaign()
+
+	var renewed leaderLease
+	json.Unmarshal(ds.values[a.key], &renewed)
+	if !a.IsLeader() || renewed.Leader != a.self || renewed.ExpiresAt <= lease.ExpiresAt {
+		t.Fatalf("lease is not renewed %+v", renewed)
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+
+	ds := newTestDataStore()
+	b := newTestLeaderElection(ds, 2)
+
+	// lease of the crashed leader stays in the store without native TTL
+	value, _ := json.Marshal(&leaderLease{Leader: "1", ExpiresAt: time.Now().Add(-time.Second).UnixMilli()})
+	ds.SetRaw(context.Background(), []byte(b.key), value, 3)
+
+	b.campaign()
+	if !b.IsLeader() {
+		t.Fatal("expired lease is not taken over")
+	}
+
+	// corrupted record is a free lease as well
+	c := newTestLeaderElection(newTestDataStore(), 3)
+	c.storage.SetRaw(context.Background(), []byte(c.key), []byte("garbage"), 3)
+	c.campaign()
+	if !c.IsLeader() {
+		t.Fatal("corrupted lease is not taken over")
+	}
+}
+
+func TestLeaderResign(t *testing.T) {
+
+	ds := newTestDataStore()
+	a := newTestLeaderElection(ds, 1)
+	b := newTestLeaderElection(ds, 2)
+
+	a.campaign()
+	if err := a.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if a.IsLeader() {
+		t.Fatal("leader after resign")
+	}
+
+	b.campaign()
+	if !b.IsLeader() {
+		t.Fatal("lease is not released by resign")
+	}
+
+	if err := b.Resign(); err != nil {
+		t.Fatal(err)
+	}
+
+	// resigned node campaigns again on request
+	if !a.Campaign() {
+		t.Fatal("resigned node can not campaign again")
+	}
+}
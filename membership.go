@@ -0,0 +1,744 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/codeallergy/glue"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var MembershipServiceClass = reflect.TypeOf((*MembershipService)(nil)).Elem()
+
+type MemberStatus int
+
+const (
+	MemberAlive MemberStatus = iota
+	MemberSuspect
+	MemberLeft
+	MemberFailed
+)
+
+func (s MemberStatus) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberLeft:
+		return "left"
+	case MemberFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type MemberEventType int
+
+const (
+	MemberJoinEvent MemberEventType = iota
+	MemberUpdateEvent
+	MemberLeaveEvent
+	MemberFailedEvent
+)
+
+func (t MemberEventType) String() string {
+	switch t {
+	case MemberJoinEvent:
+		return "join"
+	case MemberUpdateEvent:
+		return "update"
+	case MemberLeaveEvent:
+		return "leave"
+	case MemberFailedEvent:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type Member struct {
+
+	/**
+	LAN name of the node from NodeService.
+	 */
+
+	Name string `json:"name"`
+
+	/**
+	Node id in hex format from NodeService.
+	 */
+
+	NodeIdHex string `json:"nodeId"`
+
+	/**
+	Host fingerprint of the node from NodeService.
+	 */
+
+	Fingerprint string `json:"fingerprint"`
+
+	/**
+	Datacenter name of the node from NodeService.
+	 */
+
+	DC string `json:"dc"`
+
+	/**
+	Membership protocol address of the node.
+	 */
+
+	Address string `json:"address"`
+
+	/**
+	Listen addresses of the node servers by server name, usually taken from Server.ListenAddress().
+	 */
+
+	Addresses map[string]string `json:"addresses,omitempty"`
+
+	/**
+	Status of the member from the local node point of view.
+	 */
+
+	Status MemberStatus `json:"-"`
+
+	/**
+	Last time in milliseconds the member was seen by the local node.
+	 */
+
+	LastSeen int64 `json:"-"`
+}
+
+type MemberEvent struct {
+	Type   MemberEventType
+	Member Member
+}
+
+/**
+Membership service discovers nodes of the cluster and detects their failures.
+ */
+
+type MembershipService interface {
+	glue.InitializingBean
+	glue.DisposableBean
+	Component
+
+	/**
+	Gets the local member.
+	 */
+
+	LocalMember() Member
+
+	/**
+	Gets all known members including local one ordered by name.
+	 */
+
+	Members() []Member
+
+	/**
+	Adds listen address of the server to the local member announcement.
+	Usually called with Server.ListenAddress() after Bind().
+	 */
+
+	Advertise(serverName string, addr net.Addr)
+
+	/**
+	Joins the cluster by contacting the existing members by membership addresses.
+	Returns number of contacted addresses. Joins again after Leave.
+	 */
+
+	Join(addresses ...string) (int, error)
+
+	/**
+	Announces leave of the local member to the cluster.
+	 */
+
+	Leave() error
+
+	/**
+	Watch membership events during specific active context.
+
+	On each call callback function should return true to continue watching on changes.
+
+	Use Application as context.
+	 */
+
+	Watch(ctx context.Context, cb func(event MemberEvent) bool) (context.CancelFunc, error)
+}
+
+/**
+Advertises listen addresses of all bound servers in child contexts with server role.
+ */
+
+func AdvertiseServers(parent glue.Context, membership MembershipService) {
+
+	for _, child := range FilterChildrenByRole(parent, ServerRole) {
+
+		ctx, err := child.Object()
+		if err != nil {
+			continue
+		}
+
+		for _, bean := range ctx.Bean(ServerClass, glue.DefaultLevel) {
+			server, ok := bean.Object().(Server)
+			if !ok || !server.Alive() {
+				continue
+			}
+			name := child.Role()
+			if nb, ok := server.(glue.NamedBean); ok {
+				name = nb.BeanName()
+			}
+			membership.Advertise(name, server.ListenAddress())
+		}
+	}
+
+}
+
+const (
+	membershipAlive = "alive"
+	membershipLeave = "leave"
+
+	membershipMaxMessage = 64 * 1024
+)
+
+type membershipMessage struct {
+	Type  string   `json:"type"`
+	From  Member   `json:"from"`
+	Peers []string `json:"peers,omitempty"`
+}
+
+type membershipWatcher struct {
+	cb   func(event MemberEvent) bool
+	once sync.Once
+	done chan struct{}
+}
+
+type implLocalMembershipService struct {
+	NodeService NodeService `inject:""`
+	Log         *zap.Logger `inject:"optional"`
+
+	/**
+	UDP address for the membership protocol.
+	 */
+	BindAddress string `value:"membership.bind,default=127.0.0.1:0"`
+
+	/**
+	Comma separated list of membership addresses to join on startup.
+	 */
+	JoinAddresses string `value:"membership.join,default="`
+
+	/**
+	Heartbeat interval in milliseconds.
+	 */
+	IntervalMillis int `value:"membership.interval,default=1000"`
+
+	/**
+	Number of missed heartbeats to mark member as suspect.
+	 */
+	SuspectAfter int `value:"membership.suspect-after,default=3"`
+
+	/**
+	Number of missed heartbeats to mark member as failed and remove it.
+	 */
+	FailAfter int `value:"membership.fail-after,default=10"`
+
+	conn      *net.UDPConn
+	closeOnce sync.Once
+	shutdown  chan struct{}
+	wg        sync.WaitGroup
+
+	mu         sync.Mutex
+	local      Member
+	members    map[string]*Member // address -> member, nodes with duplicate id have own entries
+	seeds      map[string]int64   // address -> time in milliseconds when learned from gossip, zero if joined explicitly
+	watchers   map[*membershipWatcher]bool
+	duplicates map[string]bool // addresses of peers with duplicate node id already reported
+}
+
+/**
+Creates membership service exchanging UDP heartbeats between nodes.
+Suitable for small clusters and several nodes on the localhost.
+ */
+
+func NewLocalMembershipService() MembershipService {
+	return &implLocalMembershipService{
+		members:  make(map[string]*Member),
+		seeds:      make(map[string]int64),
+		watchers:   make(map[*membershipWatcher]bool),
+		duplicates: make(map[string]bool),
+		shutdown:   make(chan struct{}),
+	}
+}
+
+func (t *implLocalMembershipService) BeanName() string {
+	return "membership"
+}
+
+func (t *implLocalMembershipService) PostConstruct() error {
+
+	addr, err := net.ResolveUDPAddr("udp", t.BindAddress)
+	if err != nil {
+		return errors.Errorf("invalid property 'membership.bind' value '%s', %v", t.BindAddress, err)
+	}
+
+	t.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.Errorf("membership listen on '%s', %v", t.BindAddress, err)
+	}
+
+	if t.IntervalMillis <= 0 {
+		t.IntervalMillis = 1000
+	}
+
+	if t.Log == nil {
+		t.Log = zap.NewNop()
+	}
+
+	t.local = Member{
+		Name:        t.NodeService.LANName(),
+		NodeIdHex:   t.NodeService.NodeIdHex(),
+		Fingerprint: t.NodeService.Fingerprint(),
+		DC:          t.NodeService.DCName(),
+		Address:     t.conn.LocalAddr().String(),
+		Addresses:   make(map[string]string),
+		Status:      MemberAlive,
+	}
+
+	t.wg.Add(2)
+	go t.receiveLoop()
+	go t.heartbeatLoop()
+
+	if t.JoinAddresses != "" {
+		if _, err = t.Join(strings.Split(t.JoinAddresses, ",")...); err != nil {
+			t.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *implLocalMembershipService) Destroy() error {
+	err := t.Leave()
+	t.close()
+	return err
+}
+
+/**
+Stops loops and closes the socket, Destroy is not called by context when PostConstruct fails.
+ */
+
+func (t *implLocalMembershipService) close() {
+	t.closeOnce.Do(func() {
+		close(t.shutdown)
+		t.conn.Close()
+	})
+	t.wg.Wait()
+}
+
+func (t *implLocalMembershipService) GetStats(cb func(name, value string) bool) error {
+
+	counts := make(map[MemberStatus]int)
+	for _, m := range t.Members() {
+		counts[m.Status]++
+	}
+
+	cb("members.address", t.local.Address)
+	cb("members.alive", strconv.Itoa(counts[MemberAlive]))
+	cb("members.suspect", strconv.Itoa(counts[MemberSuspect]))
+	return nil
+}
+
+func (t *implLocalMembershipService) LocalMember() Member {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return copyMember(&t.local)
+}
+
+func (t *implLocalMembershipService) Members() []Member {
+
+	t.mu.Lock()
+	list := make([]Member, 0, len(t.members)+1)
+	list = append(list, copyMember(&t.local))
+	for _, m := range t.members {
+		list = append(list, copyMember(m))
+	}
+	t.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name == list[j].Name {
+			if list[i].NodeIdHex == list[j].NodeIdHex {
+				return list[i].Address < list[j].Address
+			}
+			return list[i].NodeIdHex < list[j].NodeIdHex
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+func (t *implLocalMembershipService) Advertise(serverName string, addr net.Addr) {
+	if addr == nil || addr.String() == "" {
+		return
+	}
+	t.mu.Lock()
+	t.local.Addresses[serverName] = addr.String()
+	t.mu.Unlock()
+}
+
+func (t *implLocalMembershipService) Join(addresses ...string) (int, error) {
+
+	// join after leave announces the local member again
+	t.mu.Lock()
+	t.local.Status = MemberAlive
+	t.mu.Unlock()
+
+	var contacted int
+	var lastErr error
+
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if err := t.send(address, membershipAlive); err != nil {
+			lastErr = err
+			continue
+		}
+		t.mu.Lock()
+		t.seeds[address] = 0
+		t.mu.Unlock()
+		contacted++
+	}
+
+	if contacted == 0 && lastErr != nil {
+		return 0, errors.Errorf("membership join, %v", lastErr)
+	}
+
+	return contacted, nil
+}
+
+func (t *implLocalMembershipService) Leave() error {
+
+	t.mu.Lock()
+	if t.local.Status == MemberLeft {
+		t.mu.Unlock()
+		return nil
+	}
+	t.local.Status = MemberLeft
+	targets := t.targets()
+	t.mu.Unlock()
+
+	for _, address := range targets {
+		t.send(address, membershipLeave)
+	}
+
+	return nil
+}
+
+func (t *implLocalMembershipService) Watch(ctx context.Context, cb func(event MemberEvent) bool) (context.CancelFunc, error) {
+
+	w := &membershipWatcher{cb: cb, done: make(chan struct{})}
+
+	t.mu.Lock()
+	t.watchers[w] = true
+	t.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.unwatch(w)
+		case <-w.done:
+		case <-t.shutdown:
+		}
+	}()
+
+	return func() { t.unwatch(w) }, nil
+}
+
+func (t *implLocalMembershipService) unwatch(w *membershipWatcher) {
+	t.mu.Lock()
+	delete(t.watchers, w)
+	t.mu.Unlock()
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+/**
+Returns membership addresses of known members and seeds, should be called under lock.
+ */
+
+func (t *implLocalMembershipService) targets() []string {
+
+	set := make(map[string]bool)
+	for address := range t.seeds {
+		set[address] = true
+	}
+	for _, m := range t.members {
+		set[m.Address] = true
+	}
+	delete(set, t.local.Address)
+
+	list := make([]string, 0, len(set))
+	for address := range set {
+		list = append(list, address)
+	}
+	return list
+}
+
+func (t *implLocalMembershipService) send(address, typ string) error {
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	msg := membershipMessage{
+		Type: typ,
+		From: copyMember(&t.local),
+	}
+	for _, m := range t.members {
+		if m.Status == MemberAlive {
+			msg.Peers = append(msg.Peers, m.Address)
+		}
+	}
+	t.mu.Unlock()
+
+	content, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.conn.WriteToUDP(content, addr)
+	return err
+}
+
+func (t *implLocalMembershipService) heartbeatLoop() {
+
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(t.IntervalMillis) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		if t.local.Status == MemberLeft {
+			t.mu.Unlock()
+			continue
+		}
+		targets := t.targets()
+		t.mu.Unlock()
+
+		for _, address := range targets {
+			t.send(address, membershipAlive)
+		}
+
+		t.detectFailures()
+	}
+
+}
+
+func (t *implLocalMembershipService) detectFailures() {
+
+	now := time.Now().UnixMilli()
+	interval := int64(t.IntervalMillis)
+
+	var events []MemberEvent
+
+	t.mu.Lock()
+	for key, m := range t.members {
+		silence := now - m.LastSeen
+		switch {
+		case silence > interval*int64(t.FailAfter):
+			m.Status = MemberFailed
+			delete(t.members, key)
+			delete(t.duplicates, key)
+			events = append(events, MemberEvent{Type: MemberFailedEvent, Member: copyMember(m)})
+		case silence > interval*int64(t.SuspectAfter) && m.Status == MemberAlive:
+			m.Status = MemberSuspect
+			events = append(events, MemberEvent{Type: MemberUpdateEvent, Member: copyMember(m)})
+		}
+	}
+	// gossip seeds that never announced themselves are dropped as failed members
+	for address, learned := range t.seeds {
+		if learned > 0 && now-learned > interval*int64(t.FailAfter) {
+			delete(t.seeds, address)
+		}
+	}
+	t.mu.Unlock()
+
+	t.notify(events)
+}
+
+func (t *implLocalMembershipService) receiveLoop() {
+
+	defer t.wg.Done()
+
+	buf := make([]byte, membershipMaxMessage)
+	for {
+
+		n, _, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.shutdown:
+				return
+			default:
+				continue
+			}
+		}
+
+		var msg membershipMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+
+		t.receive(&msg)
+	}
+
+}
+
+func (t *implLocalMembershipService) receive(msg *membershipMessage) {
+
+	from := msg.From
+	if from.NodeIdHex == "" || from.Address == "" {
+		return
+	}
+
+	// the same node id from the other address is a clone, even with the same fingerprint
+	if from.NodeIdHex == t.local.NodeIdHex {
+		if from.Address != t.local.Address {
+			if peerNodeId, err := strconv.ParseUint(from.NodeIdHex, 16, 64); err == nil {
+				t.NodeService.CheckPeer(from.Name, peerNodeId, from.Fingerprint)
+			}
+		}
+		return
+	}
+
+	var events []MemberEvent
+
+	t.mu.Lock()
+
+	existing, ok := t.members[from.Address]
+
+	if !t.duplicates[from.Address] {
+		for _, m := range t.members {
+			if m.NodeIdHex == from.NodeIdHex && m.Address != from.Address {
+				t.duplicates[from.Address] = true
+				t.Log.Warn("DuplicateNodeId",
+					zap.String("nodeId", from.NodeIdHex),
+					zap.String("member", m.Name),
+					zap.String("address", m.Address),
+					zap.String("fingerprint", m.Fingerprint),
+					zap.String("peer", from.Name),
+					zap.String("peerAddress", from.Address),
+					zap.String("peerFingerprint", from.Fingerprint))
+				break
+			}
+		}
+	}
+
+	switch msg.Type {
+	case membershipLeave:
+		if ok {
+			delete(t.members, from.Address)
+			delete(t.duplicates, from.Address)
+			existing.Status = MemberLeft
+			events = append(events, MemberEvent{Type: MemberLeaveEvent, Member: copyMember(existing)})
+		}
+
+	case membershipAlive:
+		from.Status = MemberAlive
+		from.LastSeen = time.Now().UnixMilli()
+		if !ok {
+			events = append(events, MemberEvent{Type: MemberJoinEvent, Member: copyMember(&from)})
+		} else if existing.Status != MemberAlive || existing.NodeIdHex != from.NodeIdHex || !sameAddresses(existing.Addresses, from.Addresses) {
+			events = append(events, MemberEvent{Type: MemberUpdateEvent, Member: copyMember(&from)})
+		}
+		t.members[from.Address] = &from
+
+		if learned, ok := t.seeds[from.Address]; ok && learned > 0 {
+			delete(t.seeds, from.Address)
+		}
+
+		// gossip peers known by the sender become seeds until they announce themselves
+		known := make(map[string]bool)
+		for _, m := range t.members {
+			known[m.Address] = true
+		}
+		for _, peer := range msg.Peers {
+			if _, ok := t.seeds[peer]; !ok && peer != t.local.Address && !known[peer] {
+				t.seeds[peer] = from.LastSeen
+			}
+		}
+	}
+
+	t.mu.Unlock()
+
+	t.notify(events)
+}
+
+func (t *implLocalMembershipService) notify(events []MemberEvent) {
+
+	if len(events) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	watchers := make([]*membershipWatcher, 0, len(t.watchers))
+	for w := range t.watchers {
+		watchers = append(watchers, w)
+	}
+	t.mu.Unlock()
+
+	for _, w := range watchers {
+		for _, event := range events {
+			if !w.cb(event) {
+				t.unwatch(w)
+				break
+			}
+		}
+	}
+
+}
+
+func copyMember(m *Member) Member {
+	c := *m
+	c.Addresses = make(map[string]string, len(m.Addresses))
+	for k, v := range m.Addresses {
+		c.Addresses[k] = v
+	}
+	return c
+}
+
+func sameAddresses(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testNodeService struct {
+	NodeService
+	nodeId uint64
+	peers  int32
+}
+
+func (t *testNodeService) CheckPeer(peerName string, peerNodeId uint64, peerFingerprint string) error {
+	atomic.AddInt32(&t.peers, 1)
+	return nil
+}
+
+func (t *testNodeService) NodeIdHex() string   { return fmt.Sprintf("%x", t.nodeId) }
+func (t *testNodeService) LANName() string     { return fmt.Sprintf("node%d", t.nodeId) }
+func (t *testNodeService) Fingerprint() string { return t.NodeIdHex() }
+func (t *testNodeService) DCName() string      { return "default" }
+
+func newTestMembership(t *testing.T, nodeId uint64, join string) *implLocalMembershipService {
+	t.Helper()
+	m := NewLocalMembershipService().(*implLocalMembershipService)
+	m.NodeService = &testNodeService{nodeId: nodeId}
+	m.BindAddress = "127.0.0.1:0"
+	m.JoinAddresses = join
+	m.IntervalMillis = 20
+	m.SuspectAfter = 3
+	m.FailAfter = 6
+	if err := m.PostConstruct(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func watchMembership(m MembershipService) <-chan MemberEvent {
+	ch := make(chan MemberEvent, 100)
+	m.Watch(context.Background(), func(event MemberEvent) bool {
+		ch <- event
+		return true
+	})
+	return ch
+}
+
+func waitMemberEvent(t *testing.T, ch <-chan MemberEvent, typ MemberEventType, name string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-ch:
+			if event.Type == typ && event.Member.Name == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s event of member '%s'", typ, name)
+		}
+	}
+}
+
+func TestMembershipJoinGossipLeaveFailure(t *testing.T) {
+
+	a := newTestMembership(t, 1, "")
+	defer a.Destroy()
+	events := watchMembership(a)
+
+	b := newTestMembership(t, 2, a.LocalMember().Address)
+	waitMemberEvent(t, events, MemberJoinEvent, "node2")
+
+	// c knows only b and discovers a by gossip
+	c := newTestMembership(t, 3, b.LocalMember().Address)
+	waitMemberEvent(t, events, MemberJoinEvent, "node3")
+
+	if n := len(c.Members()); n != 3 {
+		t.Fatalf("expected 3 members, got %d", n)
+	}
+
+	b.Destroy()
+	waitMemberEvent(t, events, MemberLeaveEvent, "node2")
+
+	// crash without leave announcement
+	c.close()
+	waitMemberEvent(t, events, MemberFailedEvent, "node3")
+
+	if n := len(a.Members()); n != 1 {
+		t.Fatalf("expected only local member, got %d", n)
+	}
+}
+
+func TestMembershipGossipSeedExpires(t *testing.T) {
+
+	a := newTestMembership(t, 1, "")
+	defer a.Destroy()
+
+	a.receive(&membershipMessage{
+		Type:  membershipAlive,
+		From:  Member{Name: "node2", NodeIdHex: "2", Fingerprint: "2", Address: "127.0.0.1:1"},
+		Peers: []string{"127.0.0.1:2"},
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		seeds := len(a.seeds)
+		a.mu.Unlock()
+		if seeds == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gossip seed was not expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMembershipJoinFailureCloses(t *testing.T) {
+
+	m := NewLocalMembershipService().(*implLocalMembershipService)
+	m.NodeService = &testNodeService{nodeId: 1}
+	m.BindAddress = "127.0.0.1:0"
+	m.JoinAddresses = "invalid:address:port"
+
+	if err := m.PostConstruct(); err == nil {
+		t.Fatal("expected join error")
+	}
+
+	select {
+	case <-m.shutdown:
+	default:
+		t.Fatal("membership loops are not stopped")
+	}
+}
+
+func TestMembershipClonedNodeId(t *testing.T) {
+
+	a := newTestMembership(t, 1, "")
+	defer a.Destroy()
+
+	// the same node id and fingerprint from the copied application directory
+	b := newTestMembership(t, 1, a.LocalMember().Address)
+	defer b.Destroy()
+
+	node := a.NodeService.(*testNodeService)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&node.peers) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cloned node id is not checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := len(a.Members()); n != 1 {
+		t.Fatalf("clone should not be a member, got %d members", n)
+	}
+}
+
+func TestMembershipDuplicateNodeId(t *testing.T) {
+
+	a := newTestMembership(t, 1, "")
+	defer a.Destroy()
+
+	// two hosts with the same node id copied from the image
+	for _, address := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:1", "127.0.0.1:2"} {
+		a.receive(&membershipMessage{
+			Type: membershipAlive,
+			From: Member{Name: "node2", NodeIdHex: "2", Fingerprint: address, Address: address},
+		})
+	}
+
+	if n := len(a.Members()); n != 3 {
+		t.Fatalf("expected both duplicates as members, got %d members", n)
+	}
+
+	a.mu.Lock()
+	duplicates := len(a.duplicates)
+	a.mu.Unlock()
+	// each peer is reported once, not on every heartbeat
+	if duplicates != 2 {
+		t.Fatalf("expected two reported peers, got %d", duplicates)
+	}
+}
+
+func TestMembershipRejoinAfterLeave(t *testing.T) {
+
+	a := newTestMembership(t, 1, "")
+	defer a.Destroy()
+	events := watchMembership(a)
+
+	b := newTestMembership(t, 2, a.LocalMember().Address)
+	defer b.Destroy()
+	waitMemberEvent(t, events, MemberJoinEvent, "node2")
+
+	if err := b.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	waitMemberEvent(t, events, MemberLeaveEvent, "node2")
+
+	if _, err := b.Join(a.LocalMember().Address); err != nil {
+		t.Fatal(err)
+	}
+	waitMemberEvent(t, events, MemberJoinEvent, "node2")
+}
+
+func TestMembershipWatchCancel(t *testing.T) {
+
+	a := newTestMembership(t, 1, "")
+	defer a.Destroy()
+
+	for _, useCancel := range []bool{true, false} {
+		ctx, cancelCtx := context.WithCancel(context.Background())
+		cancel, err := a.Watch(ctx, func(event MemberEvent) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if useCancel {
+			cancel()
+		} else {
+			cancelCtx()
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			a.mu.Lock()
+			watchers := len(a.watchers)
+			a.mu.Unlock()
+			if watchers == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("watcher is not released")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		cancelCtx()
+	}
+}
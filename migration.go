@@ -0,0 +1,445 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+Key prefix in storage where applied migration versions are recorded.
+ */
+
+const MigrationPrefix = "migration/"
+
+/**
+Lock key of nodes applying migrations to the shared storage, value is the owner and the time in milliseconds when the lock expires.
+ */
+
+const MigrationLockKey = MigrationPrefix + "lock"
+
+/**
+Lease time of the migration lock, the holder renews it each third part of the lease while migrating,
+the lock of crashed node expires after it.
+ */
+
+var MigrationLockLease = 30 * time.Second
+
+/**
+Interval to check the lock held by the other node.
+ */
+
+var MigrationLockRetry = time.Second
+
+var MigrationClass = reflect.TypeOf((*Migration)(nil)).Elem()
+
+/**
+Versioned migration of the data in embedded storage.
+StorageService collects all Migration beans and applies pending ones in the order of versions on PostConstruct,
+therefore before servers Bind().
+ */
+
+type Migration interface {
+
+	/**
+	Unique version of the migration, usually timestamp like 20231029001.
+	 */
+
+	Version() int64
+
+	/**
+	Short description of the migration.
+	 */
+
+	Description() string
+
+	/**
+	Applies the migration to the data store.
+	 */
+
+	Up(ctx context.Context, ds store.DataStore) error
+}
+
+type MigrationState int
+
+const (
+	MigrationPending MigrationState = iota
+	MigrationApplied
+
+	/**
+	Migration recorded in storage but bean is not found.
+	 */
+	MigrationUnknown
+)
+
+func (s MigrationState) String() string {
+	switch s {
+	case MigrationPending:
+		return "pending"
+	case MigrationApplied:
+		return "applied"
+	case MigrationUnknown:
+		return "unknown"
+	default:
+		return "invalid"
+	}
+}
+
+type MigrationStatus struct {
+	Version     int64
+	Description string
+	State       MigrationState
+
+	/**
+	Time of migration in milliseconds, zero for pending.
+	 */
+
+	AppliedAt int64
+}
+
+type migrationLock struct {
+	Owner     string `json:"owner"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+type migrationRecord struct {
+	Description string `json:"description"`
+	AppliedAt   int64  `json:"appliedAt"`
+}
+
+/**
+Gets status of all migrations and recorded versions ordered by version.
+ */
+
+func GetMigrationStatus(ctx context.Context, ds store.DataStore, migrations []Migration) ([]MigrationStatus, error) {
+
+	ds, err := migrationDataStore(ds, true)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int64]Migration)
+	for _, m := range migrations {
+		if prev, ok := known[m.Version()]; ok {
+			return nil, errors.Errorf("duplicate migration version %d in '%s' and '%s'", m.Version(), prev.Description(), m.Description())
+		}
+		known[m.Version()] = m
+	}
+
+	applied := make(map[int64]migrationRecord)
+	var parseErr error
+	err = ds.EnumerateRaw(ctx, []byte(MigrationPrefix), []byte(MigrationPrefix), store.DefaultBatchSize, false, false, func(entry *store.RawEntry) bool {
+		if string(entry.Key) == MigrationLockKey {
+			return true
+		}
+		version, err := strconv.ParseInt(strings.TrimPrefix(string(entry.Key), MigrationPrefix), 10, 64)
+		if err != nil {
+			parseErr = errors.Errorf("invalid migration key '%s', %v", string(entry.Key), err)
+			return false
+		}
+		var record migrationRecord
+		if err := json.Unmarshal(entry.Value, &record); err != nil {
+			parseErr = errors.Errorf("invalid migration record '%s', %v", string(entry.Key), err)
+			return false
+		}
+		applied[version] = record
+		return true
+	})
+	if err == nil {
+		err = parseErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []MigrationStatus
+	for version, m := range known {
+		status := MigrationStatus{
+			Version:     version,
+			Description: m.Description(),
+			State:       MigrationPending,
+		}
+		if record, ok := applied[version]; ok {
+			status.State = MigrationApplied
+			status.AppliedAt = record.AppliedAt
+		}
+		list = append(list, status)
+	}
+
+	for version, record := range applied {
+		if _, ok := known[version]; !ok {
+			list = append(list, MigrationStatus{
+				Version:     version,
+				Description: record.Description,
+				State:       MigrationUnknown,
+				AppliedAt:   record.AppliedAt,
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+
+	return list, nil
+}
+
+/**
+Applies pending migrations in the order of versions and records them in storage.
+In dry-run mode only returns migrations that would be applied.
+Stops on the first error. Returns applied or would be applied migrations.
+
+Nodes sharing the storage apply migrations one by one under MigrationLockKey,
+the node waiting for the lock finds migrations already applied.
+ */
+
+func ApplyMigrations(ctx context.Context, ds store.DataStore, migrations []Migration, dryRun bool) ([]MigrationStatus, error) {
+
+	ds, err := migrationDataStore(ds, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		lockCtx, unlock, err := lockMigrations(ctx, ds)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		// migrations stop if the lock is lost
+		ctx = lockCtx
+	}
+
+	statusList, err := GetMigrationStatus(ctx, ds, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[int64]Migration)
+	for _, m := range migrations {
+		known[m.Version()] = m
+	}
+
+	var done []MigrationStatus
+	for _, status := range statusList {
+
+		if status.State != MigrationPending {
+			continue
+		}
+
+		if dryRun {
+			done = append(done, status)
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return done, errors.Errorf("migration %d '%s', lock is lost, %v", status.Version, status.Description, err)
+		}
+
+		if err := known[status.Version].Up(ctx, ds); err != nil {
+			return done, errors.Errorf("migration %d '%s', %v", status.Version, status.Description, err)
+		}
+
+		status.State = MigrationApplied
+		status.AppliedAt = time.Now().UnixMilli()
+
+		record, err := json.Marshal(&migrationRecord{Description: status.Description, AppliedAt: status.AppliedAt})
+		if err != nil {
+			return done, err
+		}
+
+		if err := ds.SetRaw(ctx, []byte(migrationKey(status.Version)), record, store.NoTTL); err != nil {
+			return done, errors.Errorf("record migration %d, %v", status.Version, err)
+		}
+
+		done = append(done, status)
+	}
+
+	return done, nil
+}
+
+/**
+Returns data store for migrations, status and dry run only read migration records and work in read-only mode as well.
+ */
+
+func migrationDataStore(ds store.DataStore, readOnly bool) (store.DataStore, error) {
+	unguarded, err := UnguardedDataStore(ds, StorageMigrate)
+	if err != nil && readOnly {
+		return UnguardedDataStore(ds, StorageRead)
+	}
+	return unguarded, err
+}
+
+/**
+Acquires the migration lock with CAS, waits while the lock is held by the other node.
+Stored expiration time is checked as well, because not all backends support TTL.
+
+Returns context cancelled when the lock is lost and function that stops renewal and releases the lock.
+ */
+
+func lockMigrations(ctx context.Context, ds store.DataStore) (context.Context, func(), error) {
+
+	owner, err := randomToken(12)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+
+		current, version, err := getMigrationLock(ctx, ds)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if current.ExpiresAt <= time.Now().UnixMilli() {
+
+			// version protects from concurrent nodes, like in leader election
+			ok, err := setMigrationLock(ctx, ds, owner, version)
+			if err != nil {
+				return nil, nil, errors.Errorf("acquire migration lock, %v", err)
+			}
+			if ok {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, errors.Errorf("wait for migration lock, %v", ctx.Err())
+		case <-time.After(MigrationLockRetry):
+		}
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		ticker := time.NewTicker(MigrationLockLease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, version, err := getMigrationLock(lockCtx, ds)
+			if err != nil || current.Owner != owner {
+				return
+			}
+			if ok, err := setMigrationLock(lockCtx, ds, owner, version); err != nil || !ok {
+				return
+			}
+		}
+	}()
+
+	unlock := func() {
+		close(stop)
+		<-done
+		unlockMigrations(ds, owner)
+	}
+
+	return lockCtx, unlock, nil
+}
+
+/**
+Gets the migration lock record, empty record is a free lock.
+Corrupted record is an error instead of free lock, the key should be checked and removed manually.
+ */
+
+func getMigrationLock(ctx context.Context, ds store.DataStore) (*migrationLock, int64, error) {
+
+	var version int64
+	value, err := ds.GetRaw(ctx, []byte(MigrationLockKey), nil, &version, false)
+	if err != nil {
+		return nil, 0, errors.Errorf("get migration lock, %v", err)
+	}
+
+	current := new(migrationLock)
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, current); err != nil {
+			return nil, 0, errors.Errorf("corrupted migration lock '%s', %v", MigrationLockKey, err)
+		}
+	}
+
+	return current, version, nil
+}
+
+func setMigrationLock(ctx context.Context, ds store.DataStore, owner string, version int64) (bool, error) {
+
+	lock, err := json.Marshal(&migrationLock{Owner: owner, ExpiresAt: time.Now().Add(MigrationLockLease).UnixMilli()})
+	if err != nil {
+		return false, err
+	}
+
+	ttl := int(MigrationLockLease / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	return ds.CompareAndSetRaw(ctx, []byte(MigrationLockKey), lock, ttl, version)
+}
+
+/**
+Releases own migration lock, empty value with short TTL means free lock.
+ */
+
+func unlockMigrations(ds store.DataStore, owner string) {
+
+	ctx := context.Background()
+
+	current, version, err := getMigrationLock(ctx, ds)
+	if err == nil && current.Owner == owner {
+		ds.CompareAndSetRaw(ctx, []byte(MigrationLockKey), []byte{}, 1, version)
+	}
+}
+
+/**
+Formats migration status list as a table for 'migrate status' and 'migrate --dry-run' storage commands.
+ */
+
+func FormatMigrationStatus(list []MigrationStatus) string {
+
+	var out strings.Builder
+	tw := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "VERSION\tSTATE\tAPPLIED\tDESCRIPTION")
+	for _, s := range list {
+		applied := "-"
+		if s.AppliedAt > 0 {
+			applied = time.UnixMilli(s.AppliedAt).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.State, applied, s.Description)
+	}
+
+	tw.Flush()
+	return out.String()
+}
+
+/**
+Version is zero padded to keep records ordered in storage.
+ */
+
+func migrationKey(version int64) string {
+	return fmt.Sprintf("%s%020d", MigrationPrefix, version)
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/keyvalstore/store"
+	"testing"
+	"time"
+)
+
+type testMigration struct {
+	version int64
+	up      func(ctx context.Context) error
+}
+
+func (t *testMigration) Version() int64      { return t.version }
+func (t *testMigration) Description() string { return "test" }
+func (t *testMigration) Up(ctx context.Context, ds store.DataStore) error {
+	return t.up(ctx)
+}
+
+func withMigrationLockLease(t *testing.T, lease time.Duration) {
+	leaseWas, retryWas := MigrationLockLease, MigrationLockRetry
+	MigrationLockLease, MigrationLockRetry = lease, 10*time.Millisecond
+	t.Cleanup(func() {
+		MigrationLockLease, MigrationLockRetry = leaseWas, retryWas
+	})
+}
+
+func TestMigrationLockRenewed(t *testing.T) {
+
+	withMigrationLockLease(t, 150*time.Millisecond)
+	ds := newTestDataStore()
+
+	// slow migration outlives several leases
+	slow := &testMigration{version: 1, up: func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+			return nil
+		}
+	}}
+
+	other := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err := ApplyMigrations(ctx, ds, []Migration{slow}, false)
+		other <- err
+	}()
+
+	done, err := ApplyMigrations(context.Background(), ds, []Migration{slow}, false)
+	if err != nil || len(done) != 1 {
+		t.Fatalf("migration is not applied, %v", err)
+	}
+	if err := <-other; err == nil {
+		t.Fatal("the other node acquired the renewed lock")
+	}
+
+	// released lock is free for the next node, applied migration is skipped
+	done, err = ApplyMigrations(context.Background(), ds, []Migration{slow}, false)
+	if err != nil || len(done) != 0 {
+		t.Fatalf("unexpected result %v, %v", done, err)
+	}
+}
+
+func TestMigrationLockOfCrashedNode(t *testing.T) {
+
+	withMigrationLockLease(t, time.Second)
+	ds := newTestDataStore()
+
+	lock, _ := json.Marshal(&migrationLock{Owner: "crashed", ExpiresAt: time.Now().Add(100 * time.Millisecond).UnixMilli()})
+	ds.SetRaw(context.Background(), []byte(MigrationLockKey), lock, 1)
+
+	m := &testMigration{version: 1, up: func(ctx context.Context) error { return nil }}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if done, err := ApplyMigrations(ctx, ds, []Migration{m}, false); err != nil || len(done) != 1 {
+		t.Fatalf("expired lock is not taken over, %v", err)
+	}
+}
+
+func TestMigrationLockCorrupted(t *testing.T) {
+
+	ds := newTestDataStore()
+	ds.SetRaw(context.Background(), []byte(MigrationLockKey), []byte("garbage"), 0)
+
+	applied := false
+	m := &testMigration{version: 1, up: func(ctx context.Context) error {
+		applied = true
+		return nil
+	}}
+
+	if _, err := ApplyMigrations(context.Background(), ds, []Migration{m}, false); err == nil || applied {
+		t.Fatal("corrupted lock is taken as a free one")
+	}
+}
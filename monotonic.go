@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+Maximum sequence number that fits in 14 bits of UUID clock sequence field.
+ */
+
+const MaxClockSequence = 1<<14 - 1
+
+/**
+Default allowed distance between logical clock and system clock.
+ */
+
+var DefaultMaxClockSkew = time.Second
+
+/**
+Maximum time of the call waiting for the system clock, after it the logical clock runs ahead of the system clock.
+ */
+
+var MaxClockWait = 100 * time.Millisecond
+
+/**
+Monotonic clock is the source of timestamp and sequence pairs for NodeService in monotonic mode.
+ */
+
+type MonotonicClock interface {
+
+	/**
+	Returns the next pair of timestamp in milliseconds and sequence number.
+	Pairs are strictly increasing, first by timestamp and then by sequence.
+
+	On the same millisecond or clock regression the sequence number increments.
+	If sequence overflows the maximum sequence number the logical clock borrows the next millisecond.
+	If the logical clock runs ahead of the system clock more than max skew, the call waits for the system clock
+	not longer than MaxClockWait, other calls are not blocked while waiting.
+	 */
+
+	Next() (timestampMillis int64, seq int)
+
+	/**
+	Returns the last issued pair.
+	 */
+
+	Last() (timestampMillis int64, seq int)
+}
+
+type implMonotonicClock struct {
+	sync.Mutex
+
+	maxSeq        int
+	maxSkewMillis int64
+	lastMillis    int64
+	seq           int
+}
+
+/**
+Creates monotonic clock for UUID clock sequence with the allowed clock skew, use DefaultMaxClockSkew if not sure.
+ */
+
+func NewMonotonicClock(maxSkew time.Duration) MonotonicClock {
+	return NewSequenceClock(MaxClockSequence, maxSkew)
+}
+
+/**
+Creates monotonic clock with custom maximum sequence number, for example for snowflake IDs.
+ */
+
+func NewSequenceClock(maxSeq int, maxSkew time.Duration) MonotonicClock {
+	maxSkewMillis := maxSkew.Milliseconds()
+	if maxSkewMillis < 1 {
+		maxSkewMillis = 1
+	}
+	return &implMonotonicClock{
+		maxSeq:        maxSeq,
+		maxSkewMillis: maxSkewMillis,
+	}
+}
+
+func (t *implMonotonicClock) Next() (int64, int) {
+
+	var waited time.Duration
+
+	t.Lock()
+	defer t.Unlock()
+
+	for {
+
+		now := time.Now().UnixMilli()
+		if now > t.lastMillis {
+			t.lastMillis = now
+			t.seq = 0
+			return t.lastMillis, t.seq
+		}
+
+		// same millisecond or clock regression, continue logical clock
+		if t.seq < t.maxSeq {
+			t.seq++
+			return t.lastMillis, t.seq
+		}
+
+		// sequence exhausted, borrow the next millisecond if it is not too far ahead
+		// or if the call already waited too long after a large step of the system clock backwards
+		ahead := t.lastMillis + 1 - now
+		if ahead <= t.maxSkewMillis || waited >= MaxClockWait {
+			t.lastMillis++
+			t.seq = 0
+			return t.lastMillis, t.seq
+		}
+
+		// clock-skew guard, wait for the system clock to catch up without holding the lock
+		pause := time.Duration(ahead-t.maxSkewMillis) * time.Millisecond
+		if rest := MaxClockWait - waited; pause > rest {
+			pause = rest
+		}
+
+		t.Unlock()
+		time.Sleep(pause)
+		t.Lock()
+
+		waited += pause
+	}
+
+}
+
+func (t *implMonotonicClock) Last() (int64, int) {
+	t.Lock()
+	defer t.Unlock()
+	return t.lastMillis, t.seq
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func assertIncreasing(t *testing.T, lastMillis int64, lastSeq int, millis int64, seq int) {
+	t.Helper()
+	if millis < lastMillis || (millis == lastMillis && seq <= lastSeq) {
+		t.Fatalf("not increasing pair %d:%d after %d:%d", millis, seq, lastMillis, lastSeq)
+	}
+}
+
+func TestMonotonicClockSameMillisecond(t *testing.T) {
+
+	clock := NewMonotonicClock(DefaultMaxClockSkew)
+
+	lastMillis, lastSeq := clock.Next()
+	sameMillis := 0
+	for i := 0; i < 100000; i++ {
+		millis, seq := clock.Next()
+		assertIncreasing(t, lastMillis, lastSeq, millis, seq)
+		if millis == lastMillis {
+			sameMillis++
+		}
+		lastMillis, lastSeq = millis, seq
+	}
+
+	if sameMillis == 0 {
+		t.Fatal("expected calls in the same millisecond")
+	}
+}
+
+func TestMonotonicClockExhaustedSequence(t *testing.T) {
+
+	clock := NewSequenceClock(3, DefaultMaxClockSkew)
+
+	lastMillis, lastSeq := clock.Next()
+	start := lastMillis
+	for i := 0; i < 1000; i++ {
+		millis, seq := clock.Next()
+		assertIncreasing(t, lastMillis, lastSeq, millis, seq)
+		if seq > 3 {
+			t.Fatalf("sequence %d exceeds maximum", seq)
+		}
+		lastMillis, lastSeq = millis, seq
+	}
+
+	// 4 pairs per millisecond, the clock borrows milliseconds but stays within the skew
+	if ahead := lastMillis - time.Now().UnixMilli(); ahead > DefaultMaxClockSkew.Milliseconds() {
+		t.Fatalf("clock is ahead by %d ms", ahead)
+	}
+	if lastMillis-start < 1000/4-1 {
+		t.Fatalf("expected borrowed milliseconds, got %d", lastMillis-start)
+	}
+}
+
+func TestMonotonicClockRegression(t *testing.T) {
+
+	clock := NewSequenceClock(1, time.Millisecond).(*implMonotonicClock)
+
+	// system clock stepped back by one hour
+	clock.lastMillis = time.Now().Add(time.Hour).UnixMilli()
+	clock.seq = 1
+
+	start := time.Now()
+	lastMillis, lastSeq := clock.Last()
+	for i := 0; i < 3; i++ {
+		millis, seq := clock.Next()
+		assertIncreasing(t, lastMillis, lastSeq, millis, seq)
+		lastMillis, lastSeq = millis, seq
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*MaxClockWait {
+		t.Fatalf("calls waited %v after clock regression", elapsed)
+	}
+}
+
+func TestMonotonicClockConcurrent(t *testing.T) {
+
+	clock := NewMonotonicClock(DefaultMaxClockSkew)
+
+	const workers, calls = 8, 10000
+	results := make([][2]int64, workers*calls)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for i := 0; i < calls; i++ {
+				millis, seq := clock.Next()
+				results[offset+i] = [2]int64{millis, int64(seq)}
+			}
+		}(w * calls)
+	}
+	wg.Wait()
+
+	seen := make(map[[2]int64]bool, len(results))
+	for _, r := range results {
+		if seen[r] {
+			t.Fatalf("duplicate pair %d:%d", r[0], r[1])
+		}
+		seen[r] = true
+	}
+}
+
+func BenchmarkMonotonicClockNext(b *testing.B) {
+	clock := NewMonotonicClock(DefaultMaxClockSkew)
+	for i := 0; i < b.N; i++ {
+		clock.Next()
+	}
+}
+
+func BenchmarkMonotonicClockNextParallel(b *testing.B) {
+	clock := NewMonotonicClock(DefaultMaxClockSkew)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			clock.Next()
+		}
+	})
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"path"
+	"strings"
+)
+
+/**
+Prefix of properties defining client certificate mapping, for example:
+
+	auth.mtls.username=cn
+	auth.mtls.role.service=ou:backend
+	auth.mtls.role.admin=san:admin-*.internal
+	auth.mtls.role.agent=cn:agent-*
+
+Fields are 'cn', 'ou', 'o', 'san' (DNS names), 'email' and 'uri', patterns use path.Match syntax.
+Requires 'tls.ClientAuth' to verify client certificates in *tls.Config bean.
+ */
+
+const CertificateRulePrefix = "auth.mtls."
+
+var ErrNoClientCertificate = errors.New("no verified client certificate")
+
+type CertificateRule struct {
+
+	/**
+	Certificate field: cn, ou, o, san, email or uri.
+	 */
+
+	Field string
+
+	/**
+	Pattern of the field value in path.Match syntax.
+	 */
+
+	Pattern string
+
+	Role string
+}
+
+/**
+Maps verified client certificates to AuthorizedUser.
+ */
+
+type CertificateMapper struct {
+
+	/**
+	Field used as Username, default 'cn'.
+	 */
+
+	UsernameField string
+
+	Rules []CertificateRule
+}
+
+/**
+Loads certificate mapper from properties with CertificateRulePrefix.
+ */
+
+func LoadCertificateMapper(config ConfigRepository) (*CertificateMapper, error) {
+
+	mapper := &CertificateMapper{UsernameField: "cn"}
+	var lastErr error
+
+	err := config.EnumerateAll(CertificateRulePrefix, func(key, value string) bool {
+		name := strings.TrimPrefix(key, CertificateRulePrefix)
+		value = strings.TrimSpace(value)
+		switch {
+		case name == "username":
+			mapper.UsernameField = strings.ToLower(value)
+		case strings.HasPrefix(name, "role."):
+			i := strings.IndexByte(value, ':')
+			if i <= 0 {
+				lastErr = errors.Errorf("invalid certificate rule '%s=%s', expected 'field:pattern'", key, value)
+				return true
+			}
+			mapper.Rules = append(mapper.Rules, CertificateRule{
+				Field:   strings.ToLower(value[:i]),
+				Pattern: value[i+1:],
+				Role:    strings.TrimPrefix(name, "role."),
+			})
+		default:
+			lastErr = errors.Errorf("unknown certificate rule '%s'", key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mapper, lastErr
+}
+
+/**
+Returns verified leaf certificate of the client from gRPC peer info.
+Unverified certificates are ignored.
+ */
+
+func PeerCertificate(ctx context.Context) (*x509.Certificate, bool) {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return nil, false
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil, false
+	}
+
+	chains := info.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, false
+	}
+
+	return chains[0][0], true
+}
+
+/**
+Authenticates peer of the gRPC call by the verified client certificate.
+ */
+
+func (t *CertificateMapper) AuthenticatePeer(ctx context.Context) (*AuthorizedUser, error) {
+	cert, ok := PeerCertificate(ctx)
+	if !ok {
+		return nil, ErrNoClientCertificate
+	}
+	return t.Map(cert)
+}
+
+/**
+Maps certificate to AuthorizedUser, Context has 'cert.serial' and 'cert.fingerprint' entries.
+ */
+
+func (t *CertificateMapper) Map(cert *x509.Certificate) (*AuthorizedUser, error) {
+
+	field := t.UsernameField
+	if field == "" {
+		field = "cn"
+	}
+
+	values := certificateField(cert, field)
+	if len(values) == 0 || values[0] == "" {
+		return nil, errors.Errorf("empty '%s' of client certificate '%s'", field, cert.Subject)
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	user := &AuthorizedUser{
+		Username: values[0],
+		Roles:    make(map[string]bool),
+		Context: map[string]string{
+			"cert.serial":      cert.SerialNumber.String(),
+			"cert.fingerprint": hex.EncodeToString(fingerprint[:]),
+		},
+		ExpiresAt: cert.NotAfter.UnixMilli(),
+	}
+
+	for _, rule := range t.Rules {
+		for _, value := range certificateField(cert, rule.Field) {
+			if ok, _ := path.Match(rule.Pattern, value); ok {
+				user.Roles[rule.Role] = true
+				break
+			}
+		}
+	}
+
+	return user, nil
+}
+
+func certificateField(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "cn":
+		return []string{cert.Subject.CommonName}
+	case "ou":
+		return cert.Subject.OrganizationalUnit
+	case "o":
+		return cert.Subject.Organization
+	case "san", "dns":
+		return cert.DNSNames
+	case "email":
+		return cert.EmailAddresses
+	case "uri":
+		list := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			list[i] = u.String()
+		}
+		return list
+	default:
+		return nil
+	}
+}
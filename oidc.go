@@ -0,0 +1,782 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Default patterns of OIDC routers.
+ */
+
+const (
+	OIDCLoginPattern    = "/auth/oidc/login"
+	OIDCCallbackPattern = "/auth/oidc/callback"
+)
+
+/**
+Key prefix of pending OIDC logins in storage, callback may come to any node of the cluster.
+
+	auth/oidc/{state}  PKCE verifier and nonce of the login, expires in OIDCLoginTimeout
+ */
+
+const OIDCStatePrefix = "auth/oidc/"
+
+/**
+Cookie binding the login state to the user agent that started the login, protects from login CSRF.
+ */
+
+const OIDCStateCookie = "oidc_state"
+
+/**
+Prefix of properties defining claim mapping rules, for example:
+
+	oidc.claim.role.admin=groups:admins
+	oidc.claim.role.user=email_verified:true
+	oidc.claim.role.staff=hd:*
+	oidc.claim.context.email=email
+
+Role rules are 'claim:value', where value '*' matches any non empty claim and array claims match by any element.
+Context rules copy the claim value to AuthorizedUser.Context entry.
+ */
+
+const OIDCClaimRulePrefix = "oidc.claim."
+
+var OIDCLoginTimeout = 10 * time.Minute
+
+/**
+Allowed clock skew in validation of ID token expiration.
+ */
+
+var OIDCClockSkew = time.Minute
+
+/**
+Default lifetime of the token issued by OIDC login.
+ */
+
+var DefaultOIDCTokenTTL = time.Hour
+
+type OIDCConfig struct {
+
+	/**
+	Issuer URL of the provider, discovery document is loaded from '{Issuer}/.well-known/openid-configuration'.
+	 */
+
+	Issuer string
+
+	ClientId     string
+	ClientSecret string
+
+	/**
+	Absolute URL of the callback router registered in the provider.
+	 */
+
+	RedirectURL string
+
+	/**
+	Requested scopes, default 'openid profile email'.
+	 */
+
+	Scopes []string
+
+	/**
+	Claim used as AuthorizedUser.Username, default 'sub'.
+	 */
+
+	UsernameClaim string
+
+	Rules []ClaimRule
+
+	/**
+	Redirect URL after successful login with the token in TokenCookie.
+	Empty URL responds with JSON '{"token": "..."}'.
+	 */
+
+	SuccessURL string
+
+	/**
+	Name of cookie with the token, default 'token'.
+	 */
+
+	TokenCookie string
+
+	/**
+	Lifetime of the issued token, default DefaultOIDCTokenTTL, capped at the ID token expiration.
+	 */
+
+	TokenTTL time.Duration
+
+	/**
+	HTTP client for provider requests, default client with 10 seconds timeout.
+	 */
+
+	Client *http.Client
+}
+
+type ClaimRule struct {
+
+	Claim string
+
+	/**
+	Expected value of the claim, '*' for any non empty value.
+	 */
+
+	Value string
+
+	/**
+	Role added to AuthorizedUser if claim matches.
+	 */
+
+	Role string
+
+	/**
+	Context entry receiving the claim value.
+	 */
+
+	ContextKey string
+}
+
+/**
+Loads claim rules from properties with OIDCClaimRulePrefix.
+ */
+
+func LoadClaimRules(config ConfigRepository) ([]ClaimRule, error) {
+
+	var rules []ClaimRule
+	var lastErr error
+
+	err := config.EnumerateAll(OIDCClaimRulePrefix, func(key, value string) bool {
+		name := strings.TrimPrefix(key, OIDCClaimRulePrefix)
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(name, "role."):
+			i := strings.IndexByte(value, ':')
+			if i <= 0 {
+				lastErr = errors.Errorf("invalid claim rule '%s=%s', expected 'claim:value'", key, value)
+				return true
+			}
+			rules = append(rules, ClaimRule{
+				Claim: value[:i],
+				Value: value[i+1:],
+				Role:  strings.TrimPrefix(name, "role."),
+			})
+		case strings.HasPrefix(name, "context."):
+			rules = append(rules, ClaimRule{
+				Claim:      value,
+				ContextKey: strings.TrimPrefix(name, "context."),
+			})
+		default:
+			lastErr = errors.Errorf("unknown claim rule '%s'", key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, lastErr
+}
+
+/**
+Maps ID token claims to AuthorizedUser by rules.
+ */
+
+func MapClaims(claims map[string]interface{}, usernameClaim string, rules []ClaimRule) (*AuthorizedUser, error) {
+
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return nil, errors.Errorf("empty username claim '%s'", usernameClaim)
+	}
+
+	user := &AuthorizedUser{
+		Username: username,
+		Roles:    make(map[string]bool),
+		Context:  make(map[string]string),
+	}
+
+	for _, rule := range rules {
+		value, ok := claims[rule.Claim]
+		if !ok || value == nil {
+			continue
+		}
+		if rule.Role != "" && claimMatches(value, rule.Value) {
+			user.Roles[rule.Role] = true
+		}
+		if rule.ContextKey != "" {
+			user.Context[rule.ContextKey] = claimString(value)
+		}
+	}
+
+	return user, nil
+}
+
+func claimMatches(value interface{}, expected string) bool {
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if claimMatches(item, expected) {
+				return true
+			}
+		}
+		return false
+	}
+	s := claimString(value)
+	if expected == "*" {
+		return s != ""
+	}
+	return s == expected
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			list[i] = claimString(item)
+		}
+		return strings.Join(list, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+/**
+OpenID Connect authorization code flow with PKCE.
+Successful login mints the token of the framework by AuthorizationMiddleware.GenerateToken.
+ */
+
+type OIDCClient interface {
+
+	/**
+	Redirects user agent to the authorization endpoint of the provider, sets OIDCStateCookie with the state.
+	 */
+
+	Login(w http.ResponseWriter, r *http.Request)
+
+	/**
+	Handles redirect from the provider, exchanges code and issues the token.
+	State must match OIDCStateCookie and is consumed once.
+	 */
+
+	Callback(w http.ResponseWriter, r *http.Request)
+
+	/**
+	Validates signature and claims of ID token against provider JWKS, returns claims.
+	 */
+
+	VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (map[string]interface{}, error)
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+}
+
+type implOIDCClient struct {
+	config  *OIDCConfig
+	auth    AuthorizationMiddleware
+	storage store.DataStore
+	client  *http.Client
+
+	sync.Mutex
+	discovery *oidcDiscovery
+	jwks      *JSONWebKeySet
+	jwksAt    time.Time
+}
+
+func NewOIDCClient(config *OIDCConfig, auth AuthorizationMiddleware, storage store.DataStore) OIDCClient {
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &implOIDCClient{
+		config:  config,
+		auth:    auth,
+		storage: storage,
+		client:  client,
+	}
+}
+
+func (t *implOIDCClient) Login(w http.ResponseWriter, r *http.Request) {
+
+	disc, err := t.discover(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var state oidcState
+	stateId, err := randomToken(24)
+	if err == nil {
+		state.Verifier, err = randomToken(32)
+	}
+	if err == nil {
+		state.Nonce, err = randomToken(16)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	value, _ := json.Marshal(&state)
+	if err := SetWithTtl(r.Context(), t.storage, []byte(OIDCStatePrefix+stateId), value, int(OIDCLoginTimeout/time.Second)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    stateId,
+		Path:     t.cookiePath(),
+		MaxAge:   int(OIDCLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// lax cookie is sent on the top level redirect from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	scopes := t.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", t.config.ClientId)
+	params.Set("redirect_uri", t.config.RedirectURL)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", stateId)
+	params.Set("nonce", state.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	http.Redirect(w, r, disc.AuthorizationEndpoint+sep+params.Encode(), http.StatusFound)
+}
+
+func (t *implOIDCClient) Callback(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	if e := query.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("login failed, %s %s", e, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+
+	stateId, code := query.Get("state"), query.Get("code")
+	if stateId == "" || code == "" {
+		http.Error(w, "missing state or code", http.StatusBadRequest)
+		return
+	}
+
+	stateCookie, err := r.Cookie(OIDCStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(stateId)) != 1 {
+		http.Error(w, "login state does not match the browser session", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Path:     t.cookiePath(),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// state is single use, the consumed state is empty till expiration
+	key := []byte(OIDCStatePrefix + stateId)
+	var version int64
+	value, err := t.storage.GetRaw(ctx, key, nil, &version, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(value) == 0 {
+		http.Error(w, "unknown or expired login state", http.StatusBadRequest)
+		return
+	}
+
+	consumed, err := t.storage.CompareAndSetRaw(ctx, key, []byte{}, 1, version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !consumed {
+		http.Error(w, "login state is already used", http.StatusBadRequest)
+		return
+	}
+
+	// consumed state is removed for backends without native TTL, missing state is rejected as well
+	t.storage.RemoveRaw(ctx, key)
+
+	var state oidcState
+	if err := json.Unmarshal(value, &state); err != nil {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := t.exchange(ctx, code, state.Verifier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := t.VerifyIDToken(ctx, rawIDToken, state.Nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := MapClaims(claims, t.config.UsernameClaim, t.config.Rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ttl := t.config.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultOIDCTokenTTL
+	}
+	user.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+
+	// session of the provider limits the token
+	if exp, _ := claims["exp"].(float64); int64(exp)*1000 < user.ExpiresAt {
+		user.ExpiresAt = int64(exp) * 1000
+	}
+
+	token, err := t.auth.GenerateToken(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if t.config.SuccessURL == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+
+	cookie := t.config.TokenCookie
+	if cookie == "" {
+		cookie = "token"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.UnixMilli(user.ExpiresAt),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, t.config.SuccessURL, http.StatusFound)
+}
+
+/**
+State cookie is sent only to the callback.
+ */
+
+func (t *implOIDCClient) cookiePath() string {
+	if u, err := url.Parse(t.config.RedirectURL); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return "/"
+}
+
+func (t *implOIDCClient) exchange(ctx context.Context, code, verifier string) (string, error) {
+
+	disc, err := t.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", t.config.RedirectURL)
+	form.Set("client_id", t.config.ClientId)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if t.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(t.config.ClientId), url.QueryEscape(t.config.ClientSecret))
+	}
+
+	var resp struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := t.doJSON(req, &resp); err != nil && resp.Error == "" {
+		return "", errors.Errorf("token exchange, %v", err)
+	}
+	if resp.Error != "" {
+		return "", errors.Errorf("token exchange, %s %s", resp.Error, resp.ErrorDescription)
+	}
+	if resp.IdToken == "" {
+		return "", errors.New("token exchange, empty id_token")
+	}
+
+	return resp.IdToken, nil
+}
+
+func (t *implOIDCClient) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (map[string]interface{}, error) {
+
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Errorf("malformed id token header, %v", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return nil, errors.Errorf("malformed id token header, %v", err)
+	}
+
+	switch header.Alg {
+	case RS256, ES256, EdDSA:
+	default:
+		return nil, errors.Errorf("unsupported id token algorithm '%s'", header.Alg)
+	}
+
+	jwk, err := t.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Alg != "" && jwk.Alg != header.Alg {
+		return nil, ErrInvalidSignature
+	}
+
+	pub, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Errorf("malformed id token payload, %v", err)
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Errorf("malformed id token payload, %v", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != t.config.Issuer {
+		return nil, errors.Errorf("invalid id token issuer '%s'", iss)
+	}
+
+	if !claimMatches(claims["aud"], t.config.ClientId) {
+		return nil, errors.New("id token is not issued for the client")
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if time.Unix(int64(exp), 0).Add(OIDCClockSkew).Before(time.Now()) {
+		return nil, errors.New("expired id token")
+	}
+
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("invalid id token nonce")
+	}
+
+	return claims, nil
+}
+
+/**
+Finds provider key by kid, reloads JWKS for unknown kid to pick up key rotation of the provider.
+ */
+
+func (t *implOIDCClient) key(ctx context.Context, kid string) (*JSONWebKey, error) {
+
+	disc, err := t.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	cached, loadedAt := t.jwks, t.jwksAt
+	t.Unlock()
+
+	if cached != nil {
+		if key, ok := cached.Key(kid); ok {
+			return key, nil
+		}
+		if time.Since(loadedAt) < 10*time.Second {
+			return nil, ErrUnknownSigningKey
+		}
+	}
+
+	// outbound request without the lock, slow provider does not block other logins
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, disc.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := new(JSONWebKeySet)
+	if err := t.doJSON(req, jwks); err != nil {
+		return nil, errors.Errorf("load provider jwks, %v", err)
+	}
+
+	now := time.Now()
+	t.Lock()
+	if t.jwksAt.Before(now) {
+		t.jwks, t.jwksAt = jwks, now
+	}
+	t.Unlock()
+
+	if key, ok := jwks.Key(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+func (t *implOIDCClient) discover(ctx context.Context) (*oidcDiscovery, error) {
+
+	t.Lock()
+	cached := t.discovery
+	t.Unlock()
+
+	if cached != nil {
+		return cached, nil
+	}
+
+	// outbound request without the lock, concurrent first logins may load discovery twice
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(t.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	disc := new(oidcDiscovery)
+	if err := t.doJSON(req, disc); err != nil {
+		return nil, errors.Errorf("oidc discovery of '%s', %v", t.config.Issuer, err)
+	}
+
+	if disc.Issuer != t.config.Issuer {
+		return nil, errors.Errorf("oidc discovery issuer '%s' does not match '%s'", disc.Issuer, t.config.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, errors.Errorf("incomplete oidc discovery of '%s'", t.config.Issuer)
+	}
+
+	t.Lock()
+	t.discovery = disc
+	t.Unlock()
+	return disc, nil
+}
+
+/**
+Decodes JSON response, returns error for non 2xx status after decoding the body.
+ */
+
+func (t *implOIDCClient) doJSON(req *http.Request, out interface{}) error {
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	decodeErr := json.Unmarshal(body, out)
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("status %s", resp.Status)
+	}
+	return decodeErr
+}
+
+type implFuncRouter struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+func (t *implFuncRouter) Pattern() string {
+	return t.pattern
+}
+
+func (t *implFuncRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.handler(w, r)
+}
+
+/**
+Creates login router bean, empty pattern means OIDCLoginPattern.
+ */
+
+func NewOIDCLoginRouter(client OIDCClient, pattern string) Router {
+	if pattern == "" {
+		pattern = OIDCLoginPattern
+	}
+	return &implFuncRouter{pattern: pattern, handler: client.Login}
+}
+
+/**
+Creates callback router bean, empty pattern means OIDCCallbackPattern.
+ */
+
+func NewOIDCCallbackRouter(client OIDCClient, pattern string) Router {
+	if pattern == "" {
+		pattern = OIDCCallbackPattern
+	}
+	return &implFuncRouter{pattern: pattern, handler: client.Callback}
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAuthorizationMiddleware struct {
+	AuthorizationMiddleware
+}
+
+func (t testAuthorizationMiddleware) GenerateToken(user *AuthorizedUser) (string, error) {
+	value, err := json.Marshal(user)
+	return string(value), err
+}
+
+/**
+Accepts 'Bearer {username}' headers.
+ */
+
+func (t testAuthorizationMiddleware) AuthenticateByHeader(authHeader string) (*AuthorizedUser, bool) {
+	if username := strings.TrimPrefix(authHeader, "Bearer "); username != authHeader && username != "" {
+		return &AuthorizedUser{Username: username}, true
+	}
+	return nil, false
+}
+
+type testProvider struct {
+	server *httptest.Server
+	key    *SigningKey
+
+	sync.Mutex
+	// code -> nonce and PKCE challenge of the authorization request
+	codes map[string]url.Values
+
+	// blocks JWKS responses if not nil
+	jwksGate chan struct{}
+}
+
+/**
+Stand-in identity provider with discovery, authorization, token and JWKS endpoints.
+ */
+
+func newTestProvider(t *testing.T) *testProvider {
+
+	key, err := GenerateSigningKey(RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testProvider{key: key, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code, _ := randomToken(8)
+		p.Lock()
+		p.codes[code] = query
+		p.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+query.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.Lock()
+		auth, ok := p.codes[r.Form.Get("code")]
+		delete(p.codes, r.Form.Get("code"))
+		p.Unlock()
+		challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if user, password, _ := r.BasicAuth(); !ok || user != "client" || password != "secret" ||
+			auth.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": p.sign(t, p.key, p.claims(auth.Get("nonce"))),
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		if p.jwksGate != nil {
+			<-p.jwksGate
+		}
+		jwk, _ := p.key.PublicJWK()
+		json.NewEncoder(w).Encode(&JSONWebKeySet{Keys: []*JSONWebKey{jwk}})
+	})
+
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *testProvider) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    p.server.URL,
+		"aud":    "client",
+		"sub":    "alice",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"nonce":  nonce,
+		"email":  "alice@example.com",
+		"groups": []string{"staff", "admins"},
+	}
+}
+
+func (p *testProvider) sign(t *testing.T, key *SigningKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": key.Algorithm, "kid": key.Kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	sig, err := key.Sign([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + b64(sig)
+}
+
+func newTestOIDCClient(p *testProvider) OIDCClient {
+	return newTestOIDCClientWithTTL(p, 0)
+}
+
+func newTestOIDCClientWithTTL(p *testProvider, ttl time.Duration) OIDCClient {
+	return NewOIDCClient(&OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientId:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/auth/oidc/callback",
+		Rules: []ClaimRule{
+			{Claim: "groups", Value: "admins", Role: "admin"},
+			{Claim: "email", ContextKey: "email"},
+		},
+		TokenTTL: ttl,
+	}, testAuthorizationMiddleware{}, newTestDataStore())
+}
+
+/**
+Runs login and authorization in the provider, returns callback request with the state cookie.
+ */
+
+func startTestLogin(t *testing.T, p *testProvider, client OIDCClient) *http.Request {
+
+	w := httptest.NewRecorder()
+	client.Login(w, httptest.NewRequest(http.MethodGet, OIDCLoginPattern, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status %d, %s", w.Code, w.Body.String())
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req := httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestOIDCLoginCallback(t *testing.T) {
+
+	p := newTestProvider(t)
+	defer p.server.Close()
+	client := newTestOIDCClient(p)
+
+	req := startTestLogin(t, p, client)
+
+	w := httptest.NewRecorder()
+	client.Callback(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback status %d, %s", w.Code, w.Body.String())
+	}
+
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	user := new(AuthorizedUser)
+	if err := json.Unmarshal([]byte(resp["token"]), user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || !user.Roles["admin"] || user.Roles["staff"] || user.Context["email"] != "alice@example.com" {
+		t.Fatalf("unexpected claim mapping %+v", user)
+	}
+	if expiresIn := time.Until(time.UnixMilli(user.ExpiresAt)); expiresIn <= 0 || expiresIn > DefaultOIDCTokenTTL {
+		t.Fatalf("unexpected token expiration %v", expiresIn)
+	}
+
+	// state is consumed by the first callback
+	w = httptest.NewRecorder()
+	client.Callback(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("replay status %d, %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+
+	p := newTestProvider(t)
+	defer p.server.Close()
+	client := newTestOIDCClient(p)
+
+	req := startTestLogin(t, p, client)
+
+	// callback of the attacker login in the victim browser
+	forged := httptest.NewRequest(http.MethodGet, req.URL.String(), nil)
+	forged.AddCookie(&http.Cookie{Name: OIDCStateCookie, Value: "other"})
+
+	for _, r := range []*http.Request{httptest.NewRequest(http.MethodGet, req.URL.String(), nil), forged} {
+		w := httptest.NewRecorder()
+		client.Callback(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("callback without state cookie status %d, %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+
+	p := newTestProvider(t)
+	defer p.server.Close()
+	client := newTestOIDCClient(p)
+
+	otherKey, err := GenerateSigningKey(RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		key    *SigningKey
+		change func(claims map[string]interface{})
+		valid  bool
+	}{
+		{"valid", p.key, func(map[string]interface{}) {}, true},
+		{"nonce", p.key, func(c map[string]interface{}) { c["nonce"] = "other" }, false},
+		{"audience", p.key, func(c map[string]interface{}) { c["aud"] = "other" }, false},
+		{"issuer", p.key, func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, false},
+		{"expired", p.key, func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, false},
+		{"unknown key", otherKey, func(map[string]interface{}) {}, false},
+	}
+
+	for _, c := range cases {
+		claims := p.claims("nonce")
+		c.change(claims)
+		_, err := client.VerifyIDToken(context.Background(), p.sign(t, c.key, claims), "nonce")
+		if (err == nil) != c.valid {
+			t.Errorf("%s: unexpected result %v", c.name, err)
+		}
+	}
+}
+
+func TestOIDCTokenExpirationCapped(t *testing.T) {
+
+	p := newTestProvider(t)
+	defer p.server.Close()
+
+	// ID token of the provider expires in an hour
+	client := newTestOIDCClientWithTTL(p, 24*time.Hour)
+
+	w := httptest.NewRecorder()
+	client.Callback(w, startTestLogin(t, p, client))
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback status %d, %s", w.Code, w.Body.String())
+	}
+
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	user := new(AuthorizedUser)
+	if err := json.Unmarshal([]byte(resp["token"]), user); err != nil {
+		t.Fatal(err)
+	}
+	if expiresIn := time.Until(time.UnixMilli(user.ExpiresAt)); expiresIn <= 0 || expiresIn > time.Hour {
+		t.Fatalf("token expiration %v is not capped by ID token", expiresIn)
+	}
+}
+
+func TestOIDCSlowProviderDoesNotBlockLogin(t *testing.T) {
+
+	p := newTestProvider(t)
+	defer p.server.Close()
+	client := newTestOIDCClient(p)
+
+	// discovery is loaded by the first login
+	startTestLogin(t, p, client)
+
+	p.jwksGate = make(chan struct{})
+	verified := make(chan error, 1)
+	go func() {
+		_, err := client.VerifyIDToken(context.Background(), p.sign(t, p.key, p.claims("nonce")), "nonce")
+		verified <- err
+	}()
+
+	// the other login completes while JWKS request hangs
+	done := make(chan struct{})
+	go func() {
+		startTestLogin(t, p, client)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("login is blocked by JWKS request")
+	}
+
+	close(p.jwksGate)
+	if err := <-verified; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+)
+
+/**
+Output format of query results in storage console, selected by 'format {name}' console command.
+ */
+
+type OutputFormat int
+
+const (
+	TableFormat OutputFormat = iota
+	JSONLinesFormat
+	HexFormat
+)
+
+/**
+Maximum length of the printable value in table format, longer values are truncated.
+ */
+
+var MaxTableValueLength = 64
+
+func (f OutputFormat) String() string {
+	switch f {
+	case TableFormat:
+		return "table"
+	case JSONLinesFormat:
+		return "json"
+	case HexFormat:
+		return "hex"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+Parses output format name: table, json or hex.
+ */
+
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "table":
+		return TableFormat, nil
+	case "json", "jsonl":
+		return JSONLinesFormat, nil
+	case "hex", "raw":
+		return HexFormat, nil
+	default:
+		return TableFormat, errors.Errorf("unknown output format '%s', expected 'table', 'json' or 'hex'", s)
+	}
+}
+
+/**
+Writes query result entries in output format.
+ */
+
+type EntryWriter interface {
+
+	/**
+	Writes entry, table format buffers entries till Flush.
+	 */
+
+	Write(entry *store.RawEntry) error
+
+	/**
+	Flushes buffered entries.
+	 */
+
+	Flush() error
+}
+
+/**
+Creates entry writer for output format.
+ */
+
+func NewEntryWriter(w io.Writer, format OutputFormat) EntryWriter {
+	switch format {
+	case JSONLinesFormat:
+		return &jsonEntryWriter{enc: json.NewEncoder(w)}
+	case HexFormat:
+		return &hexEntryWriter{w: w}
+	default:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		io.WriteString(tw, "KEY\tVALUE\tTTL\tVERSION\n")
+		return &tableEntryWriter{tw: tw}
+	}
+}
+
+type tableEntryWriter struct {
+	tw *tabwriter.Writer
+}
+
+func (t *tableEntryWriter) Write(entry *store.RawEntry) error {
+	_, err := io.WriteString(t.tw, printable(entry.Key, 0)+"\t"+printable(entry.Value, MaxTableValueLength)+"\t"+strconv.Itoa(entry.Ttl)+"\t"+strconv.FormatInt(entry.Version, 10)+"\n")
+	return err
+}
+
+func (t *tableEntryWriter) Flush() error {
+	return t.tw.Flush()
+}
+
+type jsonEntry struct {
+	Key      string `json:"key,omitempty"`
+	KeyHex   string `json:"keyHex,omitempty"`
+	Value    string `json:"value"`
+	ValueHex string `json:"valueHex,omitempty"`
+	Ttl      int    `json:"ttl"`
+	Version  int64  `json:"version"`
+}
+
+type jsonEntryWriter struct {
+	enc *json.Encoder
+}
+
+func (t *jsonEntryWriter) Write(entry *store.RawEntry) error {
+
+	e := jsonEntry{
+		Ttl:     entry.Ttl,
+		Version: entry.Version,
+	}
+
+	// binary data would be corrupted by JSON string encoding
+	if utf8.Valid(entry.Key) {
+		e.Key = string(entry.Key)
+	} else {
+		e.KeyHex = hex.EncodeToString(entry.Key)
+	}
+
+	if utf8.Valid(entry.Value) {
+		e.Value = string(entry.Value)
+	} else {
+		e.ValueHex = hex.EncodeToString(entry.Value)
+	}
+
+	return t.enc.Encode(&e)
+}
+
+func (t *jsonEntryWriter) Flush() error {
+	return nil
+}
+
+type hexEntryWriter struct {
+	w io.Writer
+}
+
+func (t *hexEntryWriter) Write(entry *store.RawEntry) error {
+	_, err := io.WriteString(t.w, hex.EncodeToString(entry.Key)+" "+hex.EncodeToString(entry.Value)+" "+strconv.Itoa(entry.Ttl)+" "+strconv.FormatInt(entry.Version, 10)+"\n")
+	return err
+}
+
+func (t *hexEntryWriter) Flush() error {
+	return nil
+}
+
+/**
+Returns printable string or hex with '0x' prefix for binary data, limit truncates long strings if positive.
+ */
+
+func printable(b []byte, limit int) string {
+
+	s := string(b)
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			s = "0x" + hex.EncodeToString(b)
+			break
+		}
+	}
+
+	if limit > 0 && len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut] + "..."
+	}
+
+	return s
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Prefix of properties defining quotas of gRPC methods, for example:
+
+	grpc.limit./app.SearchService/*=100/m
+	grpc.limit./app.SearchService/Export=10/h:2
+
+Exact match wins, otherwise the longest wildcard pattern. Methods without matching rule are not limited.
+ */
+
+const RateLimitPolicyPrefix = "grpc.limit."
+
+/**
+Prefix of properties defining quotas of HTTP request paths, for example:
+
+	http.limit./api/*=100/m
+	http.limit./auth/oidc/login=10/m
+ */
+
+const HttpRateLimitPolicyPrefix = "http.limit."
+
+/**
+Metadata entry and HTTP header with seconds to wait before the next call.
+ */
+
+const RetryAfterMetadata = "retry-after"
+
+type limitRule struct {
+	pattern string
+	limiter RateLimiter
+}
+
+/**
+Quotas of gRPC methods or HTTP request paths, each pattern has own buckets keyed by username or peer IP.
+ */
+
+type RateLimitPolicy struct {
+	sync.RWMutex
+
+	name     string
+	prefix   string
+	storage  store.DataStore
+	exact    map[string]RateLimiter
+	wildcard []limitRule
+}
+
+/**
+Creates policy of gRPC methods with buckets shared in storage, nil storage keeps buckets in memory of the node.
+ */
+
+func NewRateLimitPolicy(storage store.DataStore) *RateLimitPolicy {
+	return &RateLimitPolicy{
+		name:    "grpc",
+		prefix:  RateLimitPolicyPrefix,
+		storage: storage,
+		exact:   make(map[string]RateLimiter),
+	}
+}
+
+/**
+Creates policy of HTTP request paths for NewRateLimitRouter, properties have HttpRateLimitPolicyPrefix.
+ */
+
+func NewHttpRateLimitPolicy(storage store.DataStore) *RateLimitPolicy {
+	return &RateLimitPolicy{
+		name:    "http",
+		prefix:  HttpRateLimitPolicyPrefix,
+		storage: storage,
+		exact:   make(map[string]RateLimiter),
+	}
+}
+
+/**
+Adds or replaces limit for method pattern, pattern ends with '*' for wildcard.
+ */
+
+func (t *RateLimitPolicy) Add(pattern string, limit RateLimit) {
+
+	var limiter RateLimiter
+	if t.storage != nil {
+		limiter = NewStoreRateLimiter(t.storage, t.name+pattern, limit)
+	} else {
+		limiter = NewLocalRateLimiter(limit)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if strings.HasSuffix(pattern, "*") {
+		prefix := strings.TrimSuffix(pattern, "*")
+		for i, rule := range t.wildcard {
+			if rule.pattern == prefix {
+				t.wildcard[i].limiter = limiter
+				return
+			}
+		}
+		t.wildcard = append(t.wildcard, limitRule{pattern: prefix, limiter: limiter})
+		sort.Slice(t.wildcard, func(i, j int) bool {
+			return len(t.wildcard[i].pattern) > len(t.wildcard[j].pattern)
+		})
+	} else {
+		t.exact[pattern] = limiter
+	}
+}
+
+/**
+Loads limits from properties with RateLimitPolicyPrefix or HttpRateLimitPolicyPrefix, see ParseRateLimit.
+ */
+
+func (t *RateLimitPolicy) LoadConfig(config ConfigRepository) error {
+	var lastErr error
+	err := config.EnumerateAll(t.prefix, func(key, value string) bool {
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			lastErr = errors.Errorf("property '%s', %v", key, err)
+			return true
+		}
+		t.Add(strings.TrimPrefix(key, t.prefix), limit)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return lastErr
+}
+
+/**
+Finds limiter for the full method name.
+ */
+
+func (t *RateLimitPolicy) Match(fullMethod string) (RateLimiter, bool) {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	if limiter, ok := t.exact[fullMethod]; ok {
+		return limiter, true
+	}
+
+	for _, rule := range t.wildcard {
+		if strings.HasPrefix(fullMethod, rule.pattern) {
+			return rule.limiter, true
+		}
+	}
+
+	return nil, false
+}
+
+/**
+Takes token for the call of the key, returns ResourceExhausted status error and time to wait if quota is exceeded.
+Storage errors do not block calls. Calls with empty key are not limited, they do not share one bucket.
+ */
+
+func (t *RateLimitPolicy) Allow(ctx context.Context, fullMethod, key string) (time.Duration, error) {
+
+	limiter, ok := t.Match(fullMethod)
+	if !ok || key == "" {
+		return 0, nil
+	}
+
+	allowed, wait, err := limiter.Allow(ctx, key)
+	if err != nil || allowed {
+		return 0, nil
+	}
+
+	return wait, status.Errorf(codes.ResourceExhausted, "quota of '%s' exceeded, retry after %v", fullMethod, wait.Round(time.Millisecond))
+}
+
+/**
+Returns quota key of the call, username of the user authenticated before or peer IP, empty if both are unknown.
+Quota does not authenticate the call, failed authentication would be counted by AuthGuard twice.
+ */
+
+func callKey(ctx context.Context, auth AuthorizationMiddleware) string {
+	if auth != nil {
+		if user, ok := auth.UserFromContext(ctx); ok && user != nil {
+			return "user:" + user.Username
+		}
+	}
+	if ip, ok := PeerIP(ctx); ok && ip != "" {
+		return "ip:" + ip
+	}
+	return ""
+}
+
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+/**
+Creates unary interceptor for *grpc.Server enforcing quotas, auth is optional to key calls by username.
+ */
+
+func RateLimitUnaryInterceptor(auth AuthorizationMiddleware, policy *RateLimitPolicy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if wait, err := policy.Allow(ctx, info.FullMethod, callKey(ctx, auth)); err != nil {
+			grpc.SetHeader(ctx, metadata.Pairs(RetryAfterMetadata, retryAfter(wait)))
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+/**
+Creates stream interceptor for *grpc.Server enforcing quotas, auth is optional to key calls by username.
+ */
+
+func RateLimitStreamInterceptor(auth AuthorizationMiddleware, policy *RateLimitPolicy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		if wait, err := policy.Allow(ctx, info.FullMethod, callKey(ctx, auth)); err != nil {
+			ss.SetHeader(metadata.Pairs(RetryAfterMetadata, retryAfter(wait)))
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+type implRateLimitRouter struct {
+	Router
+	policy *RateLimitPolicy
+	auth   AuthorizationMiddleware
+}
+
+/**
+Wraps Router bean with the policy of request paths, responds '429 Too Many Requests' with 'Retry-After' header.
+Requests are keyed by username authenticated by 'Authorization' header or by remote IP, auth is optional.
+Requests without valid credentials are keyed by remote IP, the wrapped router rejects them.
+ */
+
+func NewRateLimitRouter(router Router, policy *RateLimitPolicy, auth AuthorizationMiddleware) Router {
+	return &implRateLimitRouter{
+		Router: router,
+		policy: policy,
+		auth:   auth,
+	}
+}
+
+func (t *implRateLimitRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if wait, err := t.policy.Allow(r.Context(), r.URL.Path, t.requestKey(r)); err != nil {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	t.Router.ServeHTTP(w, r)
+}
+
+func (t *implRateLimitRouter) requestKey(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); t.auth != nil && header != "" {
+		if user, ok := t.auth.AuthenticateByHeader(header); ok && user != nil {
+			return "user:" + user.Username
+		}
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if ip == "" {
+		return ""
+	}
+	return "ip:" + ip
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"google.golang.org/grpc/peer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testRouter struct {
+	Router
+}
+
+func (t testRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestRateLimitRouter(t *testing.T) {
+
+	policy := NewHttpRateLimitPolicy(nil)
+	policy.Add("/api/*", RateLimit{Rate: 0.001, Burst: 1})
+
+	router := NewRateLimitRouter(testRouter{}, policy, testAuthorizationMiddleware{})
+
+	serve := func(path, remoteAddr, auth string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// users behind the same IP have own buckets
+	if serve("/api/a", "10.0.0.1:1000", "Bearer alice") != http.StatusOK ||
+		serve("/api/a", "10.0.0.1:1000", "Bearer bob") != http.StatusOK {
+		t.Fatal("first requests of users are limited")
+	}
+	if serve("/api/b", "10.0.0.2:1000", "Bearer alice") != http.StatusTooManyRequests {
+		t.Fatal("user is not limited from the other IP")
+	}
+
+	// anonymous requests are keyed by IP
+	if serve("/api/a", "10.0.0.1:1000", "") != http.StatusOK || serve("/api/a", "10.0.0.1:2000", "Invalid") != http.StatusTooManyRequests {
+		t.Fatal("anonymous requests are not limited by IP")
+	}
+
+	// paths without rule and requests without peer are not limited
+	for i := 0; i < 3; i++ {
+		if serve("/public", "10.0.0.1:1000", "") != http.StatusOK || serve("/api/a", "", "") != http.StatusOK {
+			t.Fatal("unexpected limit")
+		}
+	}
+}
+
+func TestRateLimitCallKey(t *testing.T) {
+
+	ctx := context.Background()
+	if key := callKey(ctx, nil); key != "" {
+		t.Fatalf("call without peer has key '%s'", key)
+	}
+
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}})
+	if key := callKey(ctx, nil); key != "ip:10.0.0.1" {
+		t.Fatalf("unexpected key '%s'", key)
+	}
+
+	policy := NewRateLimitPolicy(nil)
+	policy.Add("/app.Service/*", RateLimit{Rate: 0.001, Burst: 1})
+	for i := 0; i < 3; i++ {
+		if _, err := policy.Allow(context.Background(), "/app.Service/Call", ""); err != nil {
+			t.Fatal("call without key is limited")
+		}
+	}
+}
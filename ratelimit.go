@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Key prefix of token buckets in storage shared by cluster nodes.
+
+	ratelimit/{name}/{key}  bucket state
+ */
+
+const RateLimitPrefix = "ratelimit/"
+
+/**
+Number of attempts to update shared bucket on concurrent changes.
+ */
+
+var RateLimitRetries = 5
+
+/**
+Token bucket limit.
+ */
+
+type RateLimit struct {
+
+	/**
+	Tokens added per second.
+	 */
+
+	Rate float64
+
+	/**
+	Capacity of the bucket.
+	 */
+
+	Burst int
+}
+
+/**
+Parses limit in format 'count/unit[:burst]', for example '10/s', '100/m:20' or '1000/h'.
+Burst is the count by default.
+ */
+
+func ParseRateLimit(s string) (RateLimit, error) {
+
+	s = strings.TrimSpace(s)
+
+	var burst string
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s, burst = s[:i], s[i+1:]
+	}
+
+	i := strings.IndexByte(s, '/')
+	if i <= 0 {
+		return RateLimit{}, errors.Errorf("invalid rate limit '%s', expected 'count/unit[:burst]'", s)
+	}
+
+	count, err := strconv.Atoi(s[:i])
+	if err != nil || count <= 0 {
+		return RateLimit{}, errors.Errorf("invalid count of rate limit '%s'", s)
+	}
+
+	var unit time.Duration
+	switch s[i+1:] {
+	case "s", "sec", "second":
+		unit = time.Second
+	case "m", "min", "minute":
+		unit = time.Minute
+	case "h", "hour":
+		unit = time.Hour
+	case "d", "day":
+		unit = 24 * time.Hour
+	default:
+		return RateLimit{}, errors.Errorf("invalid unit of rate limit '%s', expected 's', 'm', 'h' or 'd'", s)
+	}
+
+	limit := RateLimit{
+		Rate:  float64(count) / unit.Seconds(),
+		Burst: count,
+	}
+
+	if burst != "" {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, errors.Errorf("invalid burst of rate limit '%s'", burst)
+		}
+	}
+
+	return limit, nil
+}
+
+/**
+Time to refill the empty bucket.
+ */
+
+func (l RateLimit) Period() time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+/**
+Token bucket rate limiter by key, like username or IP address.
+ */
+
+type RateLimiter interface {
+
+	/**
+	Takes one token from the bucket of the key.
+	Returns false and the time to wait for the next token if the bucket is empty.
+	 */
+
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+
+	/**
+	Returns limit of the limiter.
+	 */
+
+	Limit() RateLimit
+}
+
+type bucketState struct {
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"`
+}
+
+/**
+Refills bucket by elapsed time and takes one token.
+ */
+
+func (b *bucketState) take(limit RateLimit, now int64) (bool, time.Duration) {
+
+	if b.Updated == 0 {
+		b.Tokens = float64(limit.Burst)
+	} else if elapsed := now - b.Updated; elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+float64(elapsed)/1000*limit.Rate)
+	}
+	b.Updated = now
+
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+type implStoreRateLimiter struct {
+	storage store.DataStore
+	name    string
+	limit   RateLimit
+}
+
+/**
+Creates limiter with buckets in storage shared by cluster nodes.
+ */
+
+func NewStoreRateLimiter(storage store.DataStore, name string, limit RateLimit) RateLimiter {
+	return &implStoreRateLimiter{
+		storage: storage,
+		name:    name,
+		limit:   limit,
+	}
+}
+
+func (t *implStoreRateLimiter) Limit() RateLimit {
+	return t.limit
+}
+
+func (t *implStoreRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+
+	bucketKey := []byte(RateLimitPrefix + t.name + "/" + key)
+	ttlSeconds := int(t.limit.Period()/time.Second) + 1
+
+	for i := 0; i < RateLimitRetries; i++ {
+
+		var version int64
+		value, err := t.storage.GetRaw(ctx, bucketKey, nil, &version, false)
+		if err != nil {
+			return false, 0, err
+		}
+
+		var state bucketState
+		if value != nil {
+			json.Unmarshal(value, &state)
+		}
+
+		allowed, wait := state.take(t.limit, time.Now().UnixMilli())
+		if !allowed {
+			return false, wait, nil
+		}
+
+		next, err := json.Marshal(&state)
+		if err != nil {
+			return false, 0, err
+		}
+
+		var updated bool
+		if value == nil {
+			// new bucket, concurrent creation is resolved by the last write
+			err = t.storage.SetRaw(ctx, bucketKey, next, ttlSeconds)
+			updated = err == nil
+		} else {
+			updated, err = t.storage.CompareAndSetRaw(ctx, bucketKey, next, ttlSeconds, version)
+		}
+		if err != nil {
+			return false, 0, err
+		}
+		if updated {
+			return true, 0, nil
+		}
+	}
+
+	return false, 0, errors.Errorf("concurrent update of rate limit bucket '%s'", bucketKey)
+}
+
+type implLocalRateLimiter struct {
+	limit RateLimit
+
+	sync.Mutex
+	buckets map[string]*bucketState
+	swept   int64
+}
+
+/**
+Creates limiter with buckets in memory of the node.
+ */
+
+func NewLocalRateLimiter(limit RateLimit) RateLimiter {
+	return &implLocalRateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*bucketState),
+	}
+}
+
+func (t *implLocalRateLimiter) Limit() RateLimit {
+	return t.limit
+}
+
+func (t *implLocalRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now().UnixMilli()
+	period := t.limit.Period().Milliseconds()
+
+	// full buckets are the same as missing ones
+	if now-t.swept > period {
+		for k, b := range t.buckets {
+			if now-b.Updated > period {
+				delete(t.buckets, k)
+			}
+		}
+		t.swept = now
+	}
+
+	b, ok := t.buckets[key]
+	if !ok {
+		b = new(bucketState)
+		t.buckets[key] = b
+	}
+
+	allowed, wait := b.take(t.limit, now)
+	return allowed, wait, nil
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+Prefix of properties defining access policy, for example:
+
+	auth.rbac./sprint.ControlService/*=admin
+	auth.rbac./app.UserService/GetProfile=user,admin
+	auth.rbac./grpc.health.v1.Health/*=public
+ */
+
+const AccessPolicyPrefix = "auth.rbac."
+
+const (
+
+	/**
+	Role allowing anonymous access to the method.
+	 */
+	PublicRole = "public"
+
+	/**
+	Role allowing access for any authenticated user.
+	 */
+	AuthenticatedRole = "*"
+)
+
+var MethodPolicyClass = reflect.TypeOf((*MethodPolicy)(nil)).Elem()
+
+/**
+Bean defining required roles for gRPC methods, collected to AccessPolicy.
+ */
+
+type MethodPolicy interface {
+
+	/**
+	Returns required roles by full gRPC method name patterns, user needs any of the roles.
+	Pattern is the full method name like '/package.Service/Method' or ends with '*' wildcard.
+	 */
+
+	MethodRoles() map[string][]string
+}
+
+type accessRule struct {
+	pattern string
+	roles   []string
+}
+
+/**
+Access policy maps full gRPC method names to required roles.
+Exact match wins, otherwise the longest wildcard pattern.
+ */
+
+type AccessPolicy struct {
+	sync.RWMutex
+
+	/**
+	Allow methods without matching rule, otherwise deny them.
+	 */
+
+	DefaultAllow bool
+
+	exact    map[string][]string
+	wildcard []accessRule
+}
+
+func NewAccessPolicy(defaultAllow bool) *AccessPolicy {
+	return &AccessPolicy{
+		DefaultAllow: defaultAllow,
+		exact:        make(map[string][]string),
+	}
+}
+
+/**
+Adds or replaces rule for method pattern.
+ */
+
+func (t *AccessPolicy) Add(pattern string, roles ...string) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	if strings.HasSuffix(pattern, "*") {
+		prefix := strings.TrimSuffix(pattern, "*")
+		for i, rule := range t.wildcard {
+			if rule.pattern == prefix {
+				t.wildcard[i].roles = roles
+				return
+			}
+		}
+		t.wildcard = append(t.wildcard, accessRule{pattern: prefix, roles: roles})
+		sort.Slice(t.wildcard, func(i, j int) bool {
+			return len(t.wildcard[i].pattern) > len(t.wildcard[j].pattern)
+		})
+	} else {
+		t.exact[pattern] = roles
+	}
+}
+
+/**
+Adds all rules of the method policy bean.
+ */
+
+func (t *AccessPolicy) AddPolicy(policy MethodPolicy) {
+	for pattern, roles := range policy.MethodRoles() {
+		t.Add(pattern, roles...)
+	}
+}
+
+/**
+Loads rules from properties with AccessPolicyPrefix, roles are comma separated.
+ */
+
+func (t *AccessPolicy) LoadConfig(config ConfigRepository) error {
+	return config.EnumerateAll(AccessPolicyPrefix, func(key, value string) bool {
+		var roles []string
+		for _, role := range strings.Split(value, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+		t.Add(strings.TrimPrefix(key, AccessPolicyPrefix), roles...)
+		return true
+	})
+}
+
+/**
+Finds required roles for the full method name.
+ */
+
+func (t *AccessPolicy) Match(fullMethod string) ([]string, bool) {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	if roles, ok := t.exact[fullMethod]; ok {
+		return roles, true
+	}
+
+	for _, rule := range t.wildcard {
+		if strings.HasPrefix(fullMethod, rule.pattern) {
+			return rule.roles, true
+		}
+	}
+
+	return nil, false
+}
+
+/**
+Checks access of the user to the method, user is nil for anonymous call.
+Returns gRPC status error Unauthenticated or PermissionDenied.
+ */
+
+func (t *AccessPolicy) Check(user *AuthorizedUser, fullMethod string) error {
+
+	roles, ok := t.Match(fullMethod)
+	if !ok {
+		if t.DefaultAllow {
+			return nil
+		}
+		return status.Errorf(codes.PermissionDenied, "method '%s' is not allowed by access policy", fullMethod)
+	}
+
+	for _, role := range roles {
+		if role == PublicRole {
+			return nil
+		}
+	}
+
+	if user == nil {
+		return status.Errorf(codes.Unauthenticated, "method '%s' requires authentication", fullMethod)
+	}
+
+	for _, role := range roles {
+		if role == AuthenticatedRole || user.Roles[role] {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.PermissionDenied, "user '%s' does not have any of roles %v for method '%s'", user.Username, roles, fullMethod)
+}
+
+/**
+Authorizes the call after AuthorizationMiddleware authentication and writes audit record on denial.
+ */
+
+func authorizeCall(ctx context.Context, auth AuthorizationMiddleware, policy *AccessPolicy, audit AuditLog, log *zap.Logger, fullMethod string) error {
+
+	user, _ := auth.UserFromContext(ctx)
+
+	err := policy.Check(user, fullMethod)
+	if err == nil {
+		return nil
+	}
+
+	username := ""
+	if user != nil {
+		username = user.Username
+	}
+
+	if audit != nil {
+		record := &AuditRecord{
+			Kind:     AuditDenied,
+			Username: username,
+			Method:   fullMethod,
+			Code:     status.Code(err).String(),
+		}
+		if user != nil {
+			record.Roles = userRoles(user)
+		}
+		audit.Record(record)
+	}
+
+	if log != nil {
+		log.Warn("AccessDenied",
+			zap.String("method", fullMethod),
+			zap.String("user", username),
+			zap.String("code", status.Code(err).String()))
+	}
+
+	return err
+}
+
+/**
+Creates unary interceptor for *grpc.Server enforcing access policy, audit and log are optional to record denials.
+ */
+
+func AccessUnaryInterceptor(auth AuthorizationMiddleware, policy *AccessPolicy, audit AuditLog, log *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorizeCall(ctx, auth, policy, audit, log, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+/**
+Creates stream interceptor for *grpc.Server enforcing access policy, audit and log are optional to record denials.
+ */
+
+func AccessStreamInterceptor(auth AuthorizationMiddleware, policy *AccessPolicy, audit AuditLog, log *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorizeCall(ss.Context(), auth, policy, audit, log, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+/**
+Builds access policy from config properties and MethodPolicy beans.
+ */
+
+func BuildAccessPolicy(config ConfigRepository, beans []MethodPolicy, defaultAllow bool) (*AccessPolicy, error) {
+
+	policy := NewAccessPolicy(defaultAllow)
+
+	for _, bean := range beans {
+		policy.AddPolicy(bean)
+	}
+
+	// config overrides rules of beans
+	if config != nil {
+		if err := policy.LoadConfig(config); err != nil {
+			return nil, errors.Errorf("load access policy, %v", err)
+		}
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrExpiredRefreshToken = errors.New("expired refresh token")
+	ErrRevokedRefreshToken = errors.New("revoked refresh token family")
+	ErrReusedRefreshToken  = errors.New("reused refresh token, token family revoked")
+)
+
+/**
+Key prefixes of refresh tokens in storage.
+
+	refresh/token/{sha256 of token}  refresh token record
+	refresh/family/{family}          revocation marker of the token family
+ */
+
+const (
+	RefreshTokenPrefix  = "refresh/token/"
+	RefreshFamilyPrefix = "refresh/family/"
+)
+
+/**
+Default lifetime of the refresh token.
+ */
+
+var DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+/**
+Default absolute lifetime of the token family since Issue, rotations do not extend it.
+ */
+
+var DefaultRefreshFamilyLifetime = 90 * 24 * time.Hour
+
+/**
+Server side storage of single-use refresh tokens.
+Each use rotates the token in the same family, reuse of the rotated token revokes the whole family.
+The family expires after the absolute lifetime since Issue, the user has to login again.
+
+Roles and context of the user are captured on Issue and are not re-resolved on rotation,
+revoke the family after changes of user roles to apply them before the family expires.
+ */
+
+type RefreshTokenStore interface {
+
+	/**
+	Issues new refresh token in the new family for the user.
+	 */
+
+	Issue(user *AuthorizedUser) (string, error)
+
+	/**
+	Uses refresh token and returns the user and the next refresh token in the same family.
+	Returns ErrReusedRefreshToken and revokes the family if token was already used.
+	 */
+
+	Rotate(refresh string) (*AuthorizedUser, string, error)
+
+	/**
+	Revokes the family of the refresh token, usually on logout.
+	Returns ErrInvalidRefreshToken if the token is unknown.
+	 */
+
+	Revoke(refresh string) error
+}
+
+type refreshRecord struct {
+	Family    string            `json:"family"`
+	Username  string            `json:"username"`
+	Roles     []string          `json:"roles,omitempty"`
+	Context   map[string]string `json:"context,omitempty"`
+	ExpiresAt int64             `json:"expiresAt"`
+
+	/**
+	Absolute expiration of the family in milliseconds.
+	 */
+
+	FamilyExpiresAt int64 `json:"familyExpiresAt"`
+
+	Used bool `json:"used,omitempty"`
+}
+
+type implRefreshTokenStore struct {
+	storage  store.DataStore
+	ttl      time.Duration
+	lifetime time.Duration
+}
+
+/**
+Creates refresh token store over data store with token lifetime and absolute lifetime of the token family.
+ */
+
+func NewRefreshTokenStore(storage store.DataStore, ttl, lifetime time.Duration) RefreshTokenStore {
+	return &implRefreshTokenStore{
+		storage:  storage,
+		ttl:      ttl,
+		lifetime: lifetime,
+	}
+}
+
+func (t *implRefreshTokenStore) Issue(user *AuthorizedUser) (string, error) {
+
+	family, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	var roles []string
+	for role, ok := range user.Roles {
+		if ok {
+			roles = append(roles, role)
+		}
+	}
+
+	return t.issue(context.Background(), &refreshRecord{
+		Family:          family,
+		Username:        user.Username,
+		Roles:           roles,
+		Context:         user.Context,
+		FamilyExpiresAt: time.Now().Add(t.lifetime).UnixMilli(),
+	})
+}
+
+func (t *implRefreshTokenStore) issue(ctx context.Context, record *refreshRecord) (string, error) {
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	// family is visible in the token to revoke it without lookup
+	token := record.Family + "." + secret
+
+	// rotation does not extend the family
+	record.ExpiresAt = time.Now().Add(t.ttl).UnixMilli()
+	if record.ExpiresAt > record.FamilyExpiresAt {
+		record.ExpiresAt = record.FamilyExpiresAt
+	}
+	record.Used = false
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	if err := SetWithTtl(ctx, t.storage, refreshKey(token), value, t.ttlSeconds()); err != nil {
+		return "", errors.Errorf("store refresh token, %v", err)
+	}
+
+	return token, nil
+}
+
+func (t *implRefreshTokenStore) Rotate(refresh string) (*AuthorizedUser, string, error) {
+
+	ctx := context.Background()
+
+	family, ok := refreshFamily(refresh)
+	if !ok {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	revoked, err := t.storage.GetRaw(ctx, []byte(RefreshFamilyPrefix+family), nil, nil, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if revoked != nil {
+		return nil, "", ErrRevokedRefreshToken
+	}
+
+	key := refreshKey(refresh)
+
+	var version int64
+	value, err := t.storage.GetRaw(ctx, key, nil, &version, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if value == nil {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	record := new(refreshRecord)
+	if err := json.Unmarshal(value, record); err != nil || record.Family != family {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	if record.Used {
+		if err := t.revokeFamily(ctx, family); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrReusedRefreshToken
+	}
+
+	if now := time.Now().UnixMilli(); now > record.ExpiresAt || now > record.FamilyExpiresAt {
+		return nil, "", ErrExpiredRefreshToken
+	}
+
+	// keep used token till expiration to detect reuse
+	record.Used = true
+	usedValue, err := json.Marshal(record)
+	if err != nil {
+		return nil, "", err
+	}
+
+	updated, err := t.storage.CompareAndSetRaw(ctx, key, usedValue, t.ttlSeconds(), version)
+	if err != nil {
+		return nil, "", err
+	}
+	if !updated {
+		// concurrent use of the same token is a reuse as well
+		if err := t.revokeFamily(ctx, family); err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrReusedRefreshToken
+	}
+
+	if err := SetExpiration(ctx, t.storage, key, t.ttlSeconds()); err != nil {
+		return nil, "", err
+	}
+
+	next, err := t.issue(ctx, record)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &AuthorizedUser{
+		Username: record.Username,
+		Roles:    make(map[string]bool),
+		Context:  record.Context,
+	}
+	for _, role := range record.Roles {
+		user.Roles[role] = true
+	}
+
+	return user, next, nil
+}
+
+func (t *implRefreshTokenStore) Revoke(refresh string) error {
+
+	ctx := context.Background()
+
+	family, ok := refreshFamily(refresh)
+	if !ok {
+		return ErrInvalidRefreshToken
+	}
+
+	// only the holder of the token revokes the family, knowing the family id is not enough
+	value, err := t.storage.GetRaw(ctx, refreshKey(refresh), nil, nil, false)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrInvalidRefreshToken
+	}
+
+	record := new(refreshRecord)
+	if err := json.Unmarshal(value, record); err != nil || record.Family != family {
+		return ErrInvalidRefreshToken
+	}
+
+	return t.revokeFamily(ctx, family)
+}
+
+func (t *implRefreshTokenStore) revokeFamily(ctx context.Context, family string) error {
+	marker := []byte(time.Now().UTC().Format(time.RFC3339))
+	if err := SetWithTtl(ctx, t.storage, []byte(RefreshFamilyPrefix+family), marker, t.familySeconds()); err != nil {
+		return errors.Errorf("revoke refresh token family, %v", err)
+	}
+	return nil
+}
+
+/**
+Records live as long as the token could.
+ */
+
+func (t *implRefreshTokenStore) ttlSeconds() int {
+	return int(t.ttl / time.Second)
+}
+
+/**
+Revocation marker lives as long as the latest token of the family could.
+ */
+
+func (t *implRefreshTokenStore) familySeconds() int {
+	if t.lifetime > t.ttl {
+		return int(t.lifetime / time.Second)
+	}
+	return t.ttlSeconds()
+}
+
+func refreshFamily(refresh string) (string, bool) {
+	i := strings.IndexByte(refresh, '.')
+	if i <= 0 || i == len(refresh)-1 {
+		return "", false
+	}
+	return refresh[:i], true
+}
+
+/**
+Token is stored by hash, therefore leak of storage does not leak tokens.
+ */
+
+func refreshKey(refresh string) []byte {
+	return []byte(RefreshTokenPrefix + tokenHash(refresh))
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Errorf("generate random token, %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"testing"
+	"time"
+)
+
+var testRefreshUser = &AuthorizedUser{
+	Username: "alice",
+	Roles:    map[string]bool{"admin": true},
+	Context:  map[string]string{"email": "alice@example.com"},
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+
+	tokens := NewRefreshTokenStore(newTestDataStore(), time.Hour, 24*time.Hour)
+
+	token, err := tokens.Issue(testRefreshUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	family, _ := refreshFamily(token)
+
+	for i := 0; i < 3; i++ {
+		user, next, err := tokens.Rotate(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != "alice" || !user.Roles["admin"] || user.Context["email"] != "alice@example.com" {
+			t.Fatalf("unexpected user %+v", user)
+		}
+		if next == token {
+			t.Fatal("token is not rotated")
+		}
+		if nextFamily, _ := refreshFamily(next); nextFamily != family {
+			t.Fatal("rotated token is not in the same family")
+		}
+		token = next
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+
+	tokens := NewRefreshTokenStore(newTestDataStore(), time.Hour, 24*time.Hour)
+
+	stolen, err := tokens.Issue(testRefreshUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, next, err := tokens.Rotate(stolen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := tokens.Rotate(stolen); err != ErrReusedRefreshToken {
+		t.Fatalf("expected reuse error, got %v", err)
+	}
+
+	// the legitimate token of the family is revoked as well
+	if _, _, err := tokens.Rotate(next); err != ErrRevokedRefreshToken {
+		t.Fatalf("expected revoked family, got %v", err)
+	}
+}
+
+func TestRefreshTokenFamilyExpires(t *testing.T) {
+
+	tokens := NewRefreshTokenStore(newTestDataStore(), time.Hour, 100*time.Millisecond)
+
+	token, err := tokens.Issue(testRefreshUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotation does not extend the family
+	_, token, err = tokens.Rotate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, _, err := tokens.Rotate(token); err != ErrExpiredRefreshToken {
+		t.Fatalf("expected expired token, got %v", err)
+	}
+}
+
+func TestRefreshTokenRevoke(t *testing.T) {
+
+	tokens := NewRefreshTokenStore(newTestDataStore(), time.Hour, 24*time.Hour)
+
+	token, err := tokens.Issue(testRefreshUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	family, _ := refreshFamily(token)
+	for _, forged := range []string{family + ".guessed", "invalid"} {
+		if err := tokens.Revoke(forged); err != ErrInvalidRefreshToken {
+			t.Fatalf("forged token '%s' revokes family, %v", forged, err)
+		}
+	}
+	if _, token, err = tokens.Rotate(token); err != nil {
+		t.Fatalf("family is revoked by forged token, %v", err)
+	}
+
+	if err := tokens.Revoke(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tokens.Rotate(token); err != ErrRevokedRefreshToken {
+		t.Fatalf("expected revoked family, got %v", err)
+	}
+}
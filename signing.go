@@ -0,0 +1,768 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+Supported JWT signing algorithms.
+ */
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+/**
+Key prefix of signing keys in storage, keys are shared by cluster nodes.
+
+	auth/keys/{kid}  signing key record with PKCS8 private key or HS256 secret encrypted by the key encryption key
+
+Private keys are readable through storage console, backups and snapshots only in encrypted form.
+ */
+
+const SigningKeyPrefix = "auth/keys/"
+
+/**
+Pattern of the JWKS router.
+ */
+
+const JWKSPattern = "/.well-known/jwks.json"
+
+/**
+Default period when retired key still validates tokens, must be longer than token lifetime.
+ */
+
+var DefaultKeyRetention = 7 * 24 * time.Hour
+
+var (
+	ErrNoKeyEncryptionKey = errors.New("key encryption key is required to store signing keys")
+	ErrUnknownSigningKey  = errors.New("unknown signing key")
+	ErrInvalidSignature   = errors.New("invalid token signature")
+)
+
+type SigningKey struct {
+
+	/**
+	Key id placed to 'kid' header of the token.
+	 */
+
+	Kid string
+
+	/**
+	One of HS256, RS256, ES256, EdDSA.
+	 */
+
+	Algorithm string
+
+	/**
+	*rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey or []byte secret for HS256.
+	 */
+
+	Key interface{}
+
+	/**
+	Time in milliseconds of creation and retirement, zero RetiredAt for active key.
+	 */
+
+	CreatedAt int64
+	RetiredAt int64
+}
+
+/**
+Generates new signing key with random kid for the algorithm.
+ */
+
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+
+	var key interface{}
+	var err error
+
+	switch alg {
+	case HS256:
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		key = secret
+	case RS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.Errorf("unsupported signing algorithm '%s'", alg)
+	}
+	if err != nil {
+		return nil, errors.Errorf("generate %s key, %v", alg, err)
+	}
+
+	kid, err := randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		Kid:       kid,
+		Algorithm: alg,
+		Key:       key,
+		CreatedAt: time.Now().UnixMilli(),
+	}, nil
+}
+
+/**
+Signs the signing input of JWT.
+ */
+
+func (k *SigningKey) Sign(input []byte) ([]byte, error) {
+
+	digest := sha256.Sum256(input)
+
+	switch key := k.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses fixed size r || s instead of ASN.1
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, input), nil
+	default:
+		return nil, errors.Errorf("unsupported key type %T of '%s'", k.Key, k.Kid)
+	}
+}
+
+/**
+Verifies signature of the signing input of JWT.
+ */
+
+func (k *SigningKey) Verify(input, sig []byte) bool {
+
+	if secret, ok := k.Key.([]byte); ok {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+
+	signer, ok := k.Key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	return verifySignature(signer.Public(), input, sig)
+}
+
+/**
+Verifies JWS signature of RS256, ES256 or EdDSA by public key.
+ */
+
+func verifySignature(pub crypto.PublicKey, input, sig []byte) bool {
+
+	digest := sha256.Sum256(input)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, input, sig)
+	default:
+		return false
+	}
+}
+
+/**
+Returns public JSON Web Key, false for symmetric keys.
+ */
+
+func (k *SigningKey) PublicJWK() (*JSONWebKey, bool) {
+
+	jwk := &JSONWebKey{
+		Kid: k.Kid,
+		Alg: k.Algorithm,
+		Use: "sig",
+	}
+
+	switch key := k.Key.(type) {
+	case *rsa.PrivateKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64(key.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PrivateKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		jwk.X = b64(x)
+		jwk.Y = b64(y)
+	case ed25519.PrivateKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64(key.Public().(ed25519.PublicKey))
+	default:
+		return nil, false
+	}
+
+	return jwk, true
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+/**
+Returns public key of RSA, EC P-256 or Ed25519 JSON Web Key.
+ */
+
+func (k *JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, errors.Errorf("invalid 'n' of key '%s', %v", k.Kid, err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, errors.Errorf("invalid 'e' of key '%s', %v", k.Kid, err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve '%s' of key '%s'", k.Crv, k.Kid)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, errors.Errorf("invalid 'x' of key '%s', %v", k.Kid, err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, errors.Errorf("invalid 'y' of key '%s', %v", k.Kid, err)
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.Errorf("invalid point of key '%s'", k.Kid)
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.Errorf("unsupported curve '%s' of key '%s'", k.Crv, k.Kid)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("invalid 'x' of key '%s'", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.Errorf("unsupported key type '%s' of key '%s'", k.Kty, k.Kid)
+	}
+}
+
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+/**
+Finds key by kid.
+ */
+
+func (s *JSONWebKeySet) Key(kid string) (*JSONWebKey, bool) {
+	for _, key := range s.Keys {
+		if key.Kid == kid {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+/**
+Set of signing keys used by AuthorizationMiddleware in GenerateToken and ParseToken.
+New tokens are signed by the active key, tokens of retired keys are valid during retention period.
+ */
+
+type SigningKeyRing interface {
+
+	/**
+	Returns the active key, nil if ring is empty.
+	 */
+
+	Active() *SigningKey
+
+	/**
+	Finds not expired key by kid.
+	 */
+
+	Key(kid string) (*SigningKey, bool)
+
+	/**
+	Generates new active key, the previous active key is retired.
+	 */
+
+	Rotate(alg string) (*SigningKey, error)
+
+	/**
+	Loads keys from storage, used on start and to pick up rotation of other nodes.
+	 */
+
+	Load(ctx context.Context) error
+
+	/**
+	Signs claims as JWT with the active key and 'kid' header.
+	 */
+
+	Sign(claims interface{}) (string, error)
+
+	/**
+	Verifies JWT signature by the key in 'kid' header and decodes claims.
+	Expiration of the token is checked by the caller.
+	 */
+
+	Verify(token string, claims interface{}) error
+
+	/**
+	Returns public keys of active and retired keys.
+	 */
+
+	JWKS() *JSONWebKeySet
+}
+
+type signingKeyRecord struct {
+	Kid       string `json:"kid"`
+	Algorithm string `json:"alg"`
+
+	/**
+	Private key sealed by AES-GCM with the key encryption key and kid as additional data.
+	 */
+
+	Key       []byte `json:"key"`
+	Nonce     []byte `json:"nonce"`
+	CreatedAt int64  `json:"createdAt"`
+	RetiredAt int64  `json:"retiredAt,omitempty"`
+}
+
+type implSigningKeyRing struct {
+	storage   store.DataStore
+	retention time.Duration
+	kek       cipher.AEAD
+
+	sync.RWMutex
+	keys   map[string]*SigningKey
+	active *SigningKey
+}
+
+/**
+Creates key ring persisted in storage, storage is optional for in-memory ring.
+Key encryption key of 16, 24 or 32 bytes encrypts private keys in storage, it is required with storage
+and should be kept out of the storage, for example in the environment or a secret manager.
+ */
+
+func NewSigningKeyRing(storage store.DataStore, retention time.Duration, kek []byte) (SigningKeyRing, error) {
+
+	t := &implSigningKeyRing{
+		storage:   storage,
+		retention: retention,
+		keys:      make(map[string]*SigningKey),
+	}
+
+	if storage != nil {
+		if len(kek) == 0 {
+			return nil, ErrNoKeyEncryptionKey
+		}
+		block, err := aes.NewCipher(kek)
+		if err != nil {
+			return nil, errors.Errorf("key encryption key, %v", err)
+		}
+		if t.kek, err = cipher.NewGCM(block); err != nil {
+			return nil, errors.Errorf("key encryption key, %v", err)
+		}
+	}
+
+	return t, nil
+}
+
+func (t *implSigningKeyRing) Active() *SigningKey {
+	t.RLock()
+	defer t.RUnlock()
+	return t.active
+}
+
+func (t *implSigningKeyRing) Key(kid string) (*SigningKey, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	key, ok := t.keys[kid]
+	if !ok || t.expired(key, time.Now().UnixMilli()) {
+		return nil, false
+	}
+	return key, true
+}
+
+func (t *implSigningKeyRing) expired(key *SigningKey, now int64) bool {
+	return key.RetiredAt > 0 && key.RetiredAt+t.retention.Milliseconds() < now
+}
+
+func (t *implSigningKeyRing) Rotate(alg string) (*SigningKey, error) {
+
+	key, err := GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	// new key first, the latest not retired key wins on Load if retirement fails
+	if err := t.save(key); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	if prev := t.active; prev != nil {
+		retired := *prev
+		retired.RetiredAt = now
+		if err := t.save(&retired); err != nil {
+			return nil, err
+		}
+		prev.RetiredAt = now
+	}
+
+	t.keys[key.Kid] = key
+	t.active = key
+
+	for kid, k := range t.keys {
+		if t.expired(k, now) {
+			delete(t.keys, kid)
+		}
+	}
+
+	return key, nil
+}
+
+func (t *implSigningKeyRing) save(key *SigningKey) error {
+
+	if t.storage == nil {
+		return nil
+	}
+
+	der, err := marshalSigningKey(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, t.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Errorf("generate nonce, %v", err)
+	}
+
+	value, err := json.Marshal(&signingKeyRecord{
+		Kid:       key.Kid,
+		Algorithm: key.Algorithm,
+		Key:       t.kek.Seal(nil, nonce, der, []byte(key.Kid)),
+		Nonce:     nonce,
+		CreatedAt: key.CreatedAt,
+		RetiredAt: key.RetiredAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	ttlSeconds := store.NoTTL
+	if key.RetiredAt > 0 {
+		ttlSeconds = int(t.retention / time.Second)
+	}
+
+	if err := SetWithTtl(context.Background(), t.storage, []byte(SigningKeyPrefix+key.Kid), value, ttlSeconds); err != nil {
+		return errors.Errorf("store signing key '%s', %v", key.Kid, err)
+	}
+	return nil
+}
+
+func (t *implSigningKeyRing) Load(ctx context.Context) error {
+
+	if t.storage == nil {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	keys := make(map[string]*SigningKey)
+	var active *SigningKey
+	var lastErr error
+
+	err := t.storage.EnumerateRaw(ctx, []byte(SigningKeyPrefix), []byte(SigningKeyPrefix), store.DefaultBatchSize, false, false, func(entry *store.RawEntry) bool {
+
+		record := new(signingKeyRecord)
+		if err := json.Unmarshal(entry.Value, record); err != nil {
+			lastErr = errors.Errorf("invalid signing key record '%s', %v", entry.Key, err)
+			return true
+		}
+
+		if len(record.Nonce) != t.kek.NonceSize() {
+			lastErr = errors.Errorf("invalid nonce of signing key '%s'", record.Kid)
+			return true
+		}
+
+		// record moved to the other kid fails authentication as well
+		der, err := t.kek.Open(nil, record.Nonce, record.Key, []byte(record.Kid))
+		if err != nil {
+			lastErr = errors.Errorf("decrypt signing key '%s', %v", record.Kid, err)
+			return true
+		}
+		record.Key = der
+
+		key, err := unmarshalSigningKey(record)
+		if err != nil {
+			lastErr = err
+			return true
+		}
+
+		if t.expired(key, now) {
+			return true
+		}
+		keys[key.Kid] = key
+
+		// the latest not retired key wins if nodes rotated concurrently
+		if key.RetiredAt == 0 && (active == nil || active.CreatedAt < key.CreatedAt) {
+			active = key
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Errorf("enumerate signing keys, %v", err)
+	}
+
+	t.Lock()
+	t.keys = keys
+	t.active = active
+	t.Unlock()
+
+	return lastErr
+}
+
+func (t *implSigningKeyRing) Sign(claims interface{}) (string, error) {
+
+	key := t.Active()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": key.Algorithm,
+		"typ": "JWT",
+		"kid": key.Kid,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64(header) + "." + b64(payload)
+	sig, err := key.Sign([]byte(input))
+	if err != nil {
+		return "", errors.Errorf("sign token by '%s', %v", key.Kid, err)
+	}
+
+	return input + "." + b64(sig), nil
+}
+
+func (t *implSigningKeyRing) Verify(token string, claims interface{}) error {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.Errorf("malformed token header, %v", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return errors.Errorf("malformed token header, %v", err)
+	}
+
+	key, ok := t.Key(header.Kid)
+	if !ok {
+		return ErrUnknownSigningKey
+	}
+
+	// algorithm is defined by the key, not by the token
+	if header.Alg != key.Algorithm {
+		return ErrInvalidSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.Verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.Errorf("malformed token payload, %v", err)
+	}
+
+	return json.Unmarshal(payload, claims)
+}
+
+func (t *implSigningKeyRing) JWKS() *JSONWebKeySet {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	now := time.Now().UnixMilli()
+	set := &JSONWebKeySet{Keys: []*JSONWebKey{}}
+	for _, key := range t.keys {
+		if t.expired(key, now) {
+			continue
+		}
+		if jwk, ok := key.PublicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].Kid < set.Keys[j].Kid
+	})
+	return set
+}
+
+type implJWKSRouter struct {
+	ring SigningKeyRing
+}
+
+/**
+Creates router serving public keys of the ring on JWKSPattern for other services verifying our tokens.
+ */
+
+func NewJWKSRouter(ring SigningKeyRing) Router {
+	return &implJWKSRouter{ring: ring}
+}
+
+func (t *implJWKSRouter) Pattern() string {
+	return JWKSPattern
+}
+
+func (t *implJWKSRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	content, err := json.Marshal(t.ring.JWKS())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(content)
+}
+
+func marshalSigningKey(key *SigningKey) ([]byte, error) {
+	if secret, ok := key.Key.([]byte); ok {
+		return secret, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key.Key)
+	if err != nil {
+		return nil, errors.Errorf("marshal signing key '%s', %v", key.Kid, err)
+	}
+	return der, nil
+}
+
+func unmarshalSigningKey(record *signingKeyRecord) (*SigningKey, error) {
+
+	key := &SigningKey{
+		Kid:       record.Kid,
+		Algorithm: record.Algorithm,
+		CreatedAt: record.CreatedAt,
+		RetiredAt: record.RetiredAt,
+	}
+
+	if record.Algorithm == HS256 {
+		key.Key = record.Key
+		return key, nil
+	}
+
+	pk, err := x509.ParsePKCS8PrivateKey(record.Key)
+	if err != nil {
+		return nil, errors.Errorf("parse signing key '%s', %v", record.Kid, err)
+	}
+	key.Key = pk
+	return key, nil
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKeyEncryptionKey = bytes.Repeat([]byte{7}, 32)
+
+type testClaims struct {
+	Sub string `json:"sub"`
+}
+
+func TestSigningKeySignVerify(t *testing.T) {
+
+	for _, alg := range []string{HS256, RS256, ES256, EdDSA} {
+
+		ring, _ := NewSigningKeyRing(nil, time.Hour, nil)
+		if _, err := ring.Rotate(alg); err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := ring.Sign(&testClaims{Sub: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var claims testClaims
+		if err := ring.Verify(token, &claims); err != nil || claims.Sub != "alice" {
+			t.Fatalf("%s: verify, %v", alg, err)
+		}
+
+		parts := strings.Split(token, ".")
+		forged := parts[0] + "." + b64([]byte(`{"sub":"mallory"}`)) + "." + parts[2]
+		if err := ring.Verify(forged, &claims); err != ErrInvalidSignature {
+			t.Fatalf("%s: forged payload, %v", alg, err)
+		}
+
+		// algorithm of the key is used, not the one of the token header
+		header := b64([]byte(`{"alg":"none","kid":"` + ring.Active().Kid + `"}`))
+		if err := ring.Verify(header+"."+parts[1]+"."+parts[2], &claims); err != ErrInvalidSignature {
+			t.Fatalf("%s: algorithm confusion, %v", alg, err)
+		}
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+
+	ring, _ := NewSigningKeyRing(nil, 100*time.Millisecond, nil)
+
+	first, err := ring.Rotate(RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := ring.Sign(&testClaims{Sub: "alice"})
+
+	second, err := ring.Rotate(RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active() != second || first.RetiredAt == 0 {
+		t.Fatal("previous key is not retired")
+	}
+
+	// retired key validates tokens during retention
+	var claims testClaims
+	if err := ring.Verify(oldToken, &claims); err != nil {
+		t.Fatalf("token of retired key, %v", err)
+	}
+	if n := len(ring.JWKS().Keys); n != 2 {
+		t.Fatalf("expected 2 public keys, got %d", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if err := ring.Verify(oldToken, &claims); err != ErrUnknownSigningKey {
+		t.Fatalf("token of expired key, %v", err)
+	}
+	if n := len(ring.JWKS().Keys); n != 1 {
+		t.Fatalf("expected 1 public key, got %d", n)
+	}
+}
+
+func TestSigningKeyJWKS(t *testing.T) {
+
+	ring, _ := NewSigningKeyRing(nil, time.Hour, nil)
+	ring.Rotate(HS256)
+	ring.Rotate(ES256)
+
+	set := ring.JWKS()
+	if len(set.Keys) != 1 {
+		t.Fatalf("secret of HS256 key is published, %d keys", len(set.Keys))
+	}
+
+	jwk, ok := set.Key(ring.Active().Kid)
+	if !ok {
+		t.Fatal("active key is not published")
+	}
+	pub, err := jwk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := ring.Sign(&testClaims{Sub: "alice"})
+	parts := strings.Split(token, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !verifySignature(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatal("token is not verified by the published key")
+	}
+}
+
+func TestSigningKeyEncryptedInStorage(t *testing.T) {
+
+	if _, err := NewSigningKeyRing(newTestDataStore(), time.Hour, nil); err != ErrNoKeyEncryptionKey {
+		t.Fatalf("expected missing key encryption key error, got %v", err)
+	}
+
+	ds := newTestDataStore()
+	ring, err := NewSigningKeyRing(ds, time.Hour, testKeyEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ring.Rotate(RS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := ring.Sign(&testClaims{Sub: "alice"})
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key.Key)
+	if bytes.Contains(ds.values[SigningKeyPrefix+key.Kid], []byte(base64.StdEncoding.EncodeToString(der[:48]))) {
+		t.Fatal("private key is stored in plaintext")
+	}
+
+	// other node with the same key encryption key
+	other, _ := NewSigningKeyRing(ds, time.Hour, testKeyEncryptionKey)
+	if err := other.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var claims testClaims
+	if err := other.Verify(token, &claims); err != nil {
+		t.Fatalf("loaded key does not verify, %v", err)
+	}
+
+	wrong, _ := NewSigningKeyRing(ds, time.Hour, bytes.Repeat([]byte{8}, 32))
+	if err := wrong.Load(context.Background()); err == nil || wrong.Active() != nil {
+		t.Fatal("key is decrypted by the wrong key encryption key")
+	}
+}
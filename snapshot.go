@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Name of the snapshot job registered by StorageService in JobService.
+ */
+
+const SnapshotJobName = "storage-snapshot"
+
+const (
+	snapshotFilePrefix = "snapshot-"
+	snapshotFileSuffix = ".bak"
+	snapshotTimeLayout = "20060102T150405Z"
+)
+
+/**
+Snapshot policy of the storage, usually comes from properties:
+
+	storage.snapshot.schedule     schedule of the job in JobService format, empty disables snapshots
+	storage.snapshot.dir          directory of snapshots, default '{ApplicationDir}/snapshot'
+	storage.snapshot.prefix       key prefix to snapshot, default empty for the whole storage
+	storage.snapshot.keep-daily   number of the latest daily snapshots to keep, default 7
+	storage.snapshot.keep-weekly  number of the latest weekly snapshots to keep, default 4
+ */
+
+type SnapshotPolicy struct {
+	Schedule   string
+	Dir        string
+	Prefix     string
+	KeepDaily  int
+	KeepWeekly int
+}
+
+type SnapshotInfo struct {
+
+	/**
+	Full path of the snapshot file.
+	 */
+
+	Path string
+
+	/**
+	Time of the snapshot.
+	 */
+
+	Time time.Time
+
+	/**
+	Size of the snapshot file in bytes.
+	 */
+
+	Size int64
+}
+
+/**
+Creates snapshot job for JobService, that writes backup of storage to the policy directory and applies retention.
+ */
+
+func NewSnapshotJob(storage StorageService, policy SnapshotPolicy) *JobInfo {
+	return &JobInfo{
+		Name:     SnapshotJobName,
+		Schedule: policy.Schedule,
+		ExecutionFn: func(ctx context.Context) error {
+			if _, err := TakeSnapshot(storage, policy.Dir, policy.Prefix); err != nil {
+				return err
+			}
+			_, err := ApplySnapshotRetention(policy.Dir, policy.KeepDaily, policy.KeepWeekly)
+			return err
+		},
+	}
+}
+
+/**
+Writes backup of storage with prefix to the new snapshot file in directory.
+ */
+
+func TakeSnapshot(storage StorageService, dir, prefix string) (*SnapshotInfo, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("create snapshot dir '%s', %v", dir, err)
+	}
+
+	now := time.Now().UTC()
+	fileName := filepath.Join(dir, snapshotFilePrefix+now.Format(snapshotTimeLayout)+snapshotFileSuffix)
+	tmpFile := fileName + ".tmp"
+
+	file, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Errorf("create snapshot file '%s', %v", tmpFile, err)
+	}
+
+	err = storage.Backup(file, prefix)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return nil, errors.Errorf("write snapshot file '%s', %v", tmpFile, err)
+	}
+
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		os.Remove(tmpFile)
+		return nil, errors.Errorf("rename snapshot file '%s', %v", fileName, err)
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotInfo{
+		Path: fileName,
+		Time: now,
+		Size: info.Size(),
+	}, nil
+}
+
+/**
+Lists snapshots in directory, the newest first.
+ */
+
+func ListSnapshots(dir string) ([]SnapshotInfo, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var list []SnapshotInfo
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, snapshotFilePrefix) || !strings.HasSuffix(name, snapshotFileSuffix) {
+			continue
+		}
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, snapshotFilePrefix), snapshotFileSuffix)
+		t, err := time.Parse(snapshotTimeLayout, ts)
+		if err != nil {
+			continue
+		}
+		list = append(list, SnapshotInfo{
+			Path: filepath.Join(dir, name),
+			Time: t,
+			Size: file.Size(),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.After(list[j].Time)
+	})
+
+	return list, nil
+}
+
+/**
+Removes old snapshots in directory.
+Keeps the newest snapshot of each of the latest keepDaily days and of each of the latest keepWeekly weeks.
+The newest snapshot is always kept. Returns removed files.
+ */
+
+func ApplySnapshotRetention(dir string, keepDaily, keepWeekly int) ([]string, error) {
+
+	list, err := ListSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+
+	for i, s := range list {
+
+		if i == 0 {
+			keep[s.Path] = true
+		}
+
+		day := s.Time.Format("2006-01-02")
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep[s.Path] = true
+		}
+
+		year, w := s.Time.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, w)
+		if !weeks[week] && len(weeks) < keepWeekly {
+			weeks[week] = true
+			keep[s.Path] = true
+		}
+	}
+
+	var removed []string
+	for _, s := range list {
+		if keep[s.Path] {
+			continue
+		}
+		if err := os.Remove(s.Path); err != nil {
+			return removed, errors.Errorf("remove snapshot '%s', %v", s.Path, err)
+		}
+		removed = append(removed, s.Path)
+	}
+
+	return removed, nil
+}
+
+/**
+Reports snapshot stats of directory for Component.GetStats.
+ */
+
+func GetSnapshotStats(dir string, cb func(name, value string) bool) error {
+
+	list, err := ListSnapshots(dir)
+	if err != nil {
+		return err
+	}
+
+	if !cb("snapshot.count", strconv.Itoa(len(list))) {
+		return nil
+	}
+
+	if len(list) > 0 {
+		last := list[0]
+		if !cb("snapshot.last.time", last.Time.Format(time.RFC3339)) {
+			return nil
+		}
+		cb("snapshot.last.size", strconv.FormatInt(last.Size, 10))
+	}
+
+	return nil
+}
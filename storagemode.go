@@ -0,0 +1,323 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"context"
+	"github.com/keyvalstore/store"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+var (
+	ErrStorageReadOnly    = errors.New("storage is in read-only mode, writes are blocked")
+	ErrStorageMaintenance = errors.New("storage is in maintenance mode, access is blocked")
+)
+
+type StorageMode int32
+
+const (
+
+	/**
+	Reads and writes are allowed.
+	 */
+	StorageNormal StorageMode = iota
+
+	/**
+	Reads are allowed, writes are blocked with ErrStorageReadOnly.
+	 */
+	StorageReadOnly
+
+	/**
+	Reads and writes are blocked with ErrStorageMaintenance, only restore, migrations and compaction are allowed.
+	Compaction is allowed in any mode, because it does not change the data.
+	 */
+	StorageMaintenance
+)
+
+func (m StorageMode) String() string {
+	switch m {
+	case StorageNormal:
+		return "normal"
+	case StorageReadOnly:
+		return "readOnly"
+	case StorageMaintenance:
+		return "maintenance"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+Parses storage mode from command line argument.
+ */
+
+func ParseStorageMode(s string) (StorageMode, error) {
+	switch strings.ToLower(s) {
+	case "normal":
+		return StorageNormal, nil
+	case "readonly", "read-only", "ro":
+		return StorageReadOnly, nil
+	case "maintenance":
+		return StorageMaintenance, nil
+	default:
+		return StorageNormal, errors.Errorf("unknown storage mode '%s', expected 'normal', 'readOnly' or 'maintenance'", s)
+	}
+}
+
+/**
+Operation on the storage checked by the mode.
+ */
+
+type StorageOperation int
+
+const (
+	StorageRead StorageOperation = iota
+	StorageWrite
+	StorageBackup
+	StorageRestore
+	StorageMigrate
+	StorageCompact
+)
+
+func (op StorageOperation) String() string {
+	switch op {
+	case StorageRead:
+		return "read"
+	case StorageWrite:
+		return "write"
+	case StorageBackup:
+		return "backup"
+	case StorageRestore:
+		return "restore"
+	case StorageMigrate:
+		return "migrate"
+	case StorageCompact:
+		return "compact"
+	default:
+		return "unknown"
+	}
+}
+
+/**
+Checks that operation is allowed in the mode, the only place of the mode rules:
+
+	normal       all operations
+	readOnly     read, backup and compact, others fail with ErrStorageReadOnly
+	maintenance  restore (including drop of the data), migrate and compact, others fail with ErrStorageMaintenance
+ */
+
+func (m StorageMode) Check(op StorageOperation) error {
+	switch m {
+	case StorageReadOnly:
+		switch op {
+		case StorageRead, StorageBackup, StorageCompact:
+			return nil
+		}
+		return ErrStorageReadOnly
+	case StorageMaintenance:
+		switch op {
+		case StorageRestore, StorageMigrate, StorageCompact:
+			return nil
+		}
+		return ErrStorageMaintenance
+	default:
+		return nil
+	}
+}
+
+/**
+Data store that checks the storage mode before each operation.
+Use it as ConfigRepository backend and in console to honor StorageService mode.
+ */
+
+type implGuardedDataStore struct {
+	store.DataStore
+	mode func() StorageMode
+}
+
+/**
+Wraps data store with the guard by mode function, usually StorageService.Mode.
+Guarded store implements store.DataStoreManager and store.TransactionalManager if the wrapped one does.
+ */
+
+func NewGuardedDataStore(ds store.DataStore, mode func() StorageMode) store.DataStore {
+
+	guarded := &implGuardedDataStore{
+		DataStore: ds,
+		mode:      mode,
+	}
+
+	manager, isManager := ds.(store.DataStoreManager)
+	transactional, isTransactional := ds.(store.TransactionalManager)
+
+	switch {
+	case isManager && isTransactional:
+		return &implGuardedManagedTransactionalDataStore{guarded, &implGuardedManager{manager, mode}, transactional}
+	case isManager:
+		return &implGuardedManagedDataStore{guarded, &implGuardedManager{manager, mode}}
+	case isTransactional:
+		return &implGuardedTransactionalDataStore{guarded, transactional}
+	default:
+		return guarded
+	}
+}
+
+/**
+Returns the wrapped data store of the guarded one for operation like restore, migrations and compaction
+allowed in maintenance mode. Returns error if the operation is not allowed in the current mode,
+other data stores are returned as is.
+ */
+
+func UnguardedDataStore(ds store.DataStore, op StorageOperation) (store.DataStore, error) {
+	if g, ok := ds.(interface {
+		unguarded(op StorageOperation) (store.DataStore, error)
+	}); ok {
+		return g.unguarded(op)
+	}
+	return ds, nil
+}
+
+func (t *implGuardedDataStore) unguarded(op StorageOperation) (store.DataStore, error) {
+	if err := t.mode().Check(op); err != nil {
+		return nil, err
+	}
+	return t.DataStore, nil
+}
+
+type implGuardedManager struct {
+	manager store.DataStoreManager
+	mode    func() StorageMode
+}
+
+type implGuardedManagedDataStore struct {
+	*implGuardedDataStore
+	*implGuardedManager
+}
+
+type implGuardedTransactionalDataStore struct {
+	*implGuardedDataStore
+	store.TransactionalManager
+}
+
+type implGuardedManagedTransactionalDataStore struct {
+	*implGuardedDataStore
+	*implGuardedManager
+	store.TransactionalManager
+}
+
+func (t *implGuardedManager) Compact(discardRatio float64) error {
+	if err := t.mode().Check(StorageCompact); err != nil {
+		return err
+	}
+	return t.manager.Compact(discardRatio)
+}
+
+func (t *implGuardedManager) Backup(w io.Writer, since uint64) (uint64, error) {
+	if err := t.mode().Check(StorageBackup); err != nil {
+		return 0, err
+	}
+	return t.manager.Backup(w, since)
+}
+
+func (t *implGuardedManager) Restore(r io.Reader) error {
+	if err := t.mode().Check(StorageRestore); err != nil {
+		return err
+	}
+	return t.manager.Restore(r)
+}
+
+func (t *implGuardedManager) DropAll() error {
+	if err := t.mode().Check(StorageRestore); err != nil {
+		return err
+	}
+	return t.manager.DropAll()
+}
+
+func (t *implGuardedManager) DropWithPrefix(prefix []byte) error {
+	if err := t.mode().Check(StorageRestore); err != nil {
+		return err
+	}
+	return t.manager.DropWithPrefix(prefix)
+}
+
+func (t *implGuardedDataStore) Get(ctx context.Context) *store.GetOperation {
+	return &store.GetOperation{DataStore: t, Context: ctx}
+}
+
+func (t *implGuardedDataStore) Set(ctx context.Context) *store.SetOperation {
+	return &store.SetOperation{DataStore: t, Context: ctx}
+}
+
+func (t *implGuardedDataStore) Increment(ctx context.Context) *store.IncrementOperation {
+	return &store.IncrementOperation{DataStore: t, Context: ctx, Delta: 1}
+}
+
+func (t *implGuardedDataStore) CompareAndSet(ctx context.Context) *store.CompareAndSetOperation {
+	return &store.CompareAndSetOperation{DataStore: t, Context: ctx}
+}
+
+func (t *implGuardedDataStore) Touch(ctx context.Context) *store.TouchOperation {
+	return &store.TouchOperation{DataStore: t, Context: ctx}
+}
+
+func (t *implGuardedDataStore) Remove(ctx context.Context) *store.RemoveOperation {
+	return &store.RemoveOperation{DataStore: t, Context: ctx}
+}
+
+func (t *implGuardedDataStore) Enumerate(ctx context.Context) *store.EnumerateOperation {
+	return &store.EnumerateOperation{DataStore: t, Context: ctx}
+}
+
+func (t *implGuardedDataStore) GetRaw(ctx context.Context, key []byte, ttlPtr *int, versionPtr *int64, required bool) ([]byte, error) {
+	if err := t.mode().Check(StorageRead); err != nil {
+		return nil, err
+	}
+	return t.DataStore.GetRaw(ctx, key, ttlPtr, versionPtr, required)
+}
+
+func (t *implGuardedDataStore) SetRaw(ctx context.Context, key, value []byte, ttlSeconds int) error {
+	if err := t.mode().Check(StorageWrite); err != nil {
+		return err
+	}
+	return t.DataStore.SetRaw(ctx, key, value, ttlSeconds)
+}
+
+func (t *implGuardedDataStore) CompareAndSetRaw(ctx context.Context, key, value []byte, ttlSeconds int, version int64) (bool, error) {
+	if err := t.mode().Check(StorageWrite); err != nil {
+		return false, err
+	}
+	return t.DataStore.CompareAndSetRaw(ctx, key, value, ttlSeconds, version)
+}
+
+func (t *implGuardedDataStore) IncrementRaw(ctx context.Context, key []byte, initial, delta int64, ttlSeconds int) (int64, error) {
+	if err := t.mode().Check(StorageWrite); err != nil {
+		return 0, err
+	}
+	return t.DataStore.IncrementRaw(ctx, key, initial, delta, ttlSeconds)
+}
+
+func (t *implGuardedDataStore) TouchRaw(ctx context.Context, key []byte, ttlSeconds int) error {
+	if err := t.mode().Check(StorageWrite); err != nil {
+		return err
+	}
+	return t.DataStore.TouchRaw(ctx, key, ttlSeconds)
+}
+
+func (t *implGuardedDataStore) RemoveRaw(ctx context.Context, key []byte) error {
+	if err := t.mode().Check(StorageWrite); err != nil {
+		return err
+	}
+	return t.DataStore.RemoveRaw(ctx, key)
+}
+
+func (t *implGuardedDataStore) EnumerateRaw(ctx context.Context, prefix, seek []byte, batchSize int, onlyKeys bool, reverse bool, cb func(*store.RawEntry) bool) error {
+	if err := t.mode().Check(StorageRead); err != nil {
+		return err
+	}
+	return t.DataStore.EnumerateRaw(ctx, prefix, seek, batchSize, onlyKeys, reverse, cb)
+}
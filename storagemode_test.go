@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2023 Zander Schwid & Co. LLC.
+ * SPDX-License-Identifier: BUSL-1.1
+ */
+
+package sprint
+
+import (
+	"bytes"
+	"context"
+	"github.com/keyvalstore/store"
+	"io"
+	"testing"
+)
+
+type testManagedDataStore struct {
+	*testDataStore
+}
+
+func (t testManagedDataStore) Compact(discardRatio float64) error               { return nil }
+func (t testManagedDataStore) Backup(w io.Writer, since uint64) (uint64, error) { return 0, nil }
+func (t testManagedDataStore) Restore(r io.Reader) error                        { return nil }
+func (t testManagedDataStore) DropAll() error                                   { return nil }
+func (t testManagedDataStore) DropWithPrefix(prefix []byte) error               { return nil }
+
+func TestStorageModeOperations(t *testing.T) {
+
+	allowed := map[StorageMode]map[StorageOperation]bool{
+		StorageNormal:      {StorageRead: true, StorageWrite: true, StorageBackup: true, StorageRestore: true, StorageMigrate: true, StorageCompact: true},
+		StorageReadOnly:    {StorageRead: true, StorageBackup: true, StorageCompact: true},
+		StorageMaintenance: {StorageRestore: true, StorageMigrate: true, StorageCompact: true},
+	}
+
+	ctx := context.Background()
+
+	for mode, ops := range allowed {
+
+		current := mode
+		ds := NewGuardedDataStore(testManagedDataStore{newTestDataStore()}, func() StorageMode { return current })
+		manager := ds.(store.DataStoreManager)
+
+		calls := map[StorageOperation]func() error{
+			StorageRead: func() error {
+				_, err := ds.GetRaw(ctx, []byte("a"), nil, nil, false)
+				return err
+			},
+			StorageWrite: func() error {
+				return ds.SetRaw(ctx, []byte("a"), []byte("1"), 0)
+			},
+			StorageBackup: func() error {
+				_, err := manager.Backup(io.Discard, 0)
+				return err
+			},
+			StorageRestore: func() error {
+				if err := manager.Restore(bytes.NewReader(nil)); err != nil {
+					return err
+				}
+				if err := manager.DropWithPrefix([]byte("a")); err != nil {
+					return err
+				}
+				return manager.DropAll()
+			},
+			StorageMigrate: func() error {
+				_, err := ApplyMigrations(ctx, ds, nil, false)
+				return err
+			},
+			StorageCompact: func() error {
+				return CompactStore(ds, DefaultDiscardRatio)
+			},
+		}
+
+		for op, call := range calls {
+			if err := mode.Check(op); (err == nil) != ops[op] {
+				t.Errorf("%s mode, %s check: %v", mode, op, err)
+			}
+			if err := call(); (err == nil) != ops[op] {
+				t.Errorf("%s mode, %s operation: %v", mode, op, err)
+			}
+		}
+	}
+}